@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+/*
+BrokenRef is a comic whose cover files are missing from the file storer
+*/
+type BrokenRef struct {
+	Comic *Comic
+	/* stored paths referenced by the comic that couldn't be found */
+	Missing []string
+	/* true if the original cover exists so the other files can be regenerated */
+	HasOriginal bool
+}
+
+/*
+CoverAudit is the result of cross referencing the comics in the db with the file storer
+*/
+type CoverAudit struct {
+	/* stored files that aren't referenced by any comic */
+	Orphans []string
+	Broken  []BrokenRef
+}
+
+/*
+auditDirs returns the top level storer directories that hold cover, gallery and digital copy files
+*/
+func auditDirs(specs []RenditionSpec) []string {
+	dirs := []string{"covers", "thumbs", GALLERY_DIR, GALLERY_THUMB_DIR, DIGITAL_DIR}
+	for _, spec := range specs {
+		dirs = append(dirs, spec.Dir)
+	}
+	seen := make(map[string]bool)
+	var rval []string
+	for _, dir := range dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			rval = append(rval, dir)
+		}
+	}
+	return rval
+}
+
+/*
+GetAllComics reads every comic in the db
+*/
+func GetAllComics(ds boltq.DataStore) (comics []*Comic, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		q := boltq.NewQuery([]byte(COMIC_COL), boltq.Any())
+		results, e := boltq.TxQuery(tx, q)
+		for i := 0; e == nil && i < len(results); i += 1 {
+			comic := &Comic{}
+			e = json.Unmarshal(results[i], comic)
+			if e == nil {
+				assignBookIds(comic)
+				comics = append(comics, comic)
+			}
+		}
+		return e
+	})
+	return
+}
+
+/*
+AuditCovers lists every file in the cover directories of the storer and compares
+them to the files referenced by the comics in the db
+*/
+func AuditCovers(ds boltq.DataStore, storer FileStorer, specs []RenditionSpec) (audit CoverAudit, err error) {
+	stored := make(map[string]bool)
+	dirs := auditDirs(specs)
+	for i := 0; err == nil && i < len(dirs); i += 1 {
+		var paths []string
+		paths, err = storer.List(dirs[i])
+		for _, p := range paths {
+			stored[p] = true
+		}
+	}
+
+	var comics []*Comic
+	if err == nil {
+		comics, err = GetAllComics(ds)
+	}
+	if err != nil {
+		return
+	}
+
+	referenced := make(map[string]bool)
+	for _, comic := range comics {
+		ref := BrokenRef{Comic: comic}
+		original := filepath.Join("covers", comic.CoverPath)
+		for _, p := range comic.StoredPaths() {
+			referenced[p] = true
+			if !stored[p] {
+				ref.Missing = append(ref.Missing, p)
+			}
+		}
+		if len(ref.Missing) > 0 {
+			ref.HasOriginal = stored[original]
+			audit.Broken = append(audit.Broken, ref)
+		}
+	}
+
+	for p := range stored {
+		if !referenced[p] {
+			audit.Orphans = append(audit.Orphans, p)
+		}
+	}
+	sort.Strings(audit.Orphans)
+	return
+}
+
+/*
+DeleteOrphans removes the orphaned files from the storer, returning the number deleted
+*/
+func DeleteOrphans(storer FileStorer, orphans []string) (deleted int, err error) {
+	for i := 0; err == nil && i < len(orphans); i += 1 {
+		dirName, fileName := filepath.Split(orphans[i])
+		err = storer.Delete(dirName, fileName)
+		if err == nil {
+			deleted += 1
+		}
+	}
+	return
+}
+
+/*
+RegenerateRenditions recreates the renditions of the comic's cover from the stored original
+and saves the updated comic
+*/
+func RegenerateRenditions(ds boltq.DataStore, storer FileStorer, specs []RenditionSpec,
+	comic *Comic) error {
+
+	original := filepath.Join("covers", comic.CoverPath)
+	dirName, fileName := filepath.Split(original)
+	file, _, err := storer.Load(dirName, fileName)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	img, err := decodeCover(data)
+	if err == nil {
+		baseName := strings.TrimSuffix(filepath.Base(comic.CoverPath), filepath.Ext(comic.CoverPath))
+		var renditions []CoverRendition
+		renditions, err = storeRenditions(img, specs, storer, comic.SeriesKey(), baseName)
+		if err == nil {
+			comic.Renditions = renditions
+			comic.SpecsKey = SpecsKey(specs)
+			comic.CoverHash = FormatCoverHash(CoverHash(img))
+			err = storeComic(ds, comic.CreateKey(), comic, SYSTEM_EDITOR)
+		}
+	}
+	if err == nil {
+		err = UpdateCoverHashIndex(ds, *comic)
+	}
+	return err
+}
+
+/*
+ComicAuditHandler handles requests to the cover storage audit page
+*/
+type ComicAuditHandler struct {
+	loginTemplate   *template.Template
+	blockedTemplate *template.Template
+	auditTemplate   *template.Template
+	ds              boltq.DataStore
+	storer          FileStorer
+	imgPrefix       string
+}
+
+/*
+ComicsAudit creates a new ComicAuditHandler
+*/
+func ComicsAudit(db *bolt.DB, webroot string, local bool) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	audit := CreateTemplate(webroot, "base.html", "comicaudit.template")
+	ds := boltq.DataStore{db}
+	storer := NewFileStorer(ds, webroot, local)
+	imgPrefix := getImgPrefix(ds, local)
+	return &Wrapper{ComicAuditHandler{login, block, audit, ds, storer, imgPrefix}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicAuditHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	var err *AppError
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "Admin", "")
+	if authorized && templateErr == nil {
+		specs := GetRenditions(h.ds)
+		audit, auditErr := AuditCovers(h.ds, h.storer, specs)
+		if auditErr == nil && r.Method == "POST" {
+			var status string
+			action := r.FormValue("action")
+			if action == "delete orphans" {
+				status = h.processDeleteOrphans(audit)
+			} else if action == "regenerate thumbnails" {
+				status = h.processRegenerate(audit, specs)
+			}
+			/* audit again so the page reflects the changes */
+			audit, auditErr = AuditCovers(h.ds, h.storer, specs)
+			data["Status"] = status
+		}
+		if auditErr != nil {
+			data["Status"] = fmt.Sprintf("Problem auditing cover storage: %v", auditErr)
+		}
+		data["Audit"] = audit
+		data["ImgPrefix"] = h.imgPrefix
+		templateErr = h.auditTemplate.Execute(w, data)
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return err
+}
+
+func (h ComicAuditHandler) processDeleteOrphans(audit CoverAudit) string {
+	deleted, err := DeleteOrphans(h.storer, audit.Orphans)
+	if err != nil {
+		return fmt.Sprintf("Deleted %d orphaned files before failing: %v", deleted, err)
+	}
+	return fmt.Sprintf("Deleted %d orphaned files", deleted)
+}
+
+func (h ComicAuditHandler) processRegenerate(audit CoverAudit, specs []RenditionSpec) string {
+	regenerated := 0
+	var failed []string
+	for _, ref := range audit.Broken {
+		if !ref.HasOriginal {
+			continue
+		}
+		err := RegenerateRenditions(h.ds, h.storer, specs, ref.Comic)
+		if err != nil {
+			log.Printf("Problem regenerating thumbnails for %v: %v", ref.Comic.FullPath(), err)
+			failed = append(failed, ref.Comic.FullPath())
+		} else {
+			regenerated += 1
+		}
+	}
+	status := fmt.Sprintf("Regenerated thumbnails for %d comics", regenerated)
+	if len(failed) > 0 {
+		status += fmt.Sprintf(", failed for %v", strings.Join(failed, ", "))
+	}
+	return status
+}
@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	/* session flash key for status messages shown after a redirect */
+	STATUS_FLASH = "status"
+	/* same limit Request.FormValue uses when it parses the form */
+	FORM_MEMORY = 32 << 20
+)
+
+/*
+ComicBooksHandler handles requests to add, edit and remove the books of a comic, books are addressed by id.
+Browser forms POST and are redirected back to the comic, other clients can use PATCH and DELETE.
+*/
+type ComicBooksHandler struct {
+	ds boltq.DataStore
+}
+
+/*
+ComicBooks creates a new ComicBooksHandler
+*/
+func ComicBooks(db *bolt.DB) *Wrapper {
+	ds := boltq.DataStore{db}
+	return &Wrapper{ComicBooksHandler{ds}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicBooksHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	login := data["Login"].(*LoginInfo)
+	if !HasRole(h.ds.DB, login.Email, "ComicUploader") {
+		return &AppError{nil, "Forbidden", http.StatusForbidden}
+	}
+	comic, key, appErr := loadVarComic(h.ds, r)
+	if appErr != nil {
+		return appErr
+	}
+
+	vars := mux.Vars(r)
+	bookStr, hasBook := vars["book"]
+	op := vars["op"]
+	var summary, status string
+	if !hasBook && r.Method == "POST" && op == "" {
+		summary, status = addBook(&comic, r)
+	} else if !hasBook {
+		comic.Books = nil
+		summary = "books cleared"
+	} else {
+		index, found := comic.FindBook(bookStr)
+		if !found {
+			return &AppError{nil, "Book not found", http.StatusNotFound}
+		}
+		if r.Method == "DELETE" || op == "delete" {
+			comic.Books = append(comic.Books[:index:index], comic.Books[index+1:]...)
+			summary = "book removed"
+		} else {
+			summary, status = editBook(&comic.Books[index], r)
+		}
+	}
+
+	var storeErr error
+	if status == "" {
+		storeErr = storeComic(h.ds, key, &comic, editorOf(r))
+		if storeErr == nil {
+			updateComicIndexes(h.ds, comic)
+		}
+	}
+
+	if r.Method == "POST" {
+		if storeErr != nil {
+			status = fmt.Sprintf("Unable to save comic: %v", storeErr.Error())
+		} else if status == "" {
+			status = summary
+		}
+		flashStatus(w, r, status)
+		http.Redirect(w, r, "/comics/"+comic.FullPath(), http.StatusSeeOther)
+		return nil
+	}
+	if storeErr != nil {
+		e := fmt.Errorf("Unable to save comic: %v", storeErr)
+		return &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+	} else if status != "" {
+		return &AppError{nil, status, http.StatusBadRequest}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+/*
+assignBookIds gives books without an id the next ids for the comic. Books stored before ids
+were added get the same ids, in order, every time they are read until the comic is saved.
+*/
+func assignBookIds(comic *Comic) {
+	for i := range comic.Books {
+		if comic.Books[i].Id > comic.BookSeq {
+			comic.BookSeq = comic.Books[i].Id
+		}
+	}
+	for i := range comic.Books {
+		if comic.Books[i].Id == 0 {
+			comic.BookSeq += 1
+			comic.Books[i].Id = comic.BookSeq
+		}
+	}
+}
+
+/*
+BookIndex returns the index of the book with the id, -1 if the comic doesn't have it
+*/
+func (comic *Comic) BookIndex(id int) int {
+	for i := range comic.Books {
+		if comic.Books[i].Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+FindBook finds the book from an id in a url or form value
+*/
+func (comic *Comic) FindBook(idStr string) (index int, found bool) {
+	id, err := strconv.Atoi(idStr)
+	if err == nil {
+		index = comic.BookIndex(id)
+	}
+	return index, err == nil && index >= 0
+}
+
+/*
+loadVarComic gets the comic in the url, errors are returned ready to send
+*/
+func loadVarComic(ds boltq.DataStore, r *http.Request) (comic Comic, key [][]byte, appErr *AppError) {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return comic, key, &AppError{nil, status, http.StatusBadRequest}
+	}
+	comic, found, err := getComic(ds, key)
+	if err != nil {
+		e := fmt.Errorf("Can't lookup comic: %v", err)
+		appErr = &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+	} else if !found {
+		appErr = &AppError{nil, "Comic not found", http.StatusNotFound}
+	}
+	return
+}
+
+/*
+processGrade reads a grade from the request and checks that it is known
+*/
+func processGrade(r *http.Request, field, currStatus string, data PageData) (grade, status string) {
+	status = processField(r, field, currStatus, func(text string) (status string) {
+		if _, known := gradeName[text]; !known {
+			status = fmt.Sprintf("Unknown grade %v", text)
+		} else {
+			grade = text
+			data[field] = text
+		}
+		return
+	})
+	return
+}
+
+/*
+addBook adds a book to the comic from the grade, value and signed fields of the request
+*/
+func addBook(comic *Comic, r *http.Request) (summary, status string) {
+	var book Book
+	data := PageData{}
+	book.Grade, status = processGrade(r, "grade", status, data)
+	book.Value, status = processMoney(r, "value", status, data)
+	book.Signed = r.FormValue("signed") == "true"
+	processSignature(&book, r, false)
+	if status == "" {
+		comic.Books = append(comic.Books, book)
+		summary = fmt.Sprintf("added %v book", book.Grade)
+	}
+	return
+}
+
+/*
+editBook updates the book from the request. PATCH requests only change the fields they include,
+forms always send every field except an unchecked signed box.
+*/
+func editBook(book *Book, r *http.Request) (summary, status string) {
+	r.ParseMultipartForm(FORM_MEMORY)
+	partial := r.Method == "PATCH"
+	edited := *book
+	data := PageData{}
+	if _, present := r.Form["grade"]; present || !partial {
+		edited.Grade, status = processGrade(r, "grade", status, data)
+	}
+	if _, present := r.Form["value"]; present || !partial {
+		edited.Value, status = processMoney(r, "value", status, data)
+	}
+	if _, present := r.Form["signed"]; present || !partial {
+		edited.Signed = r.FormValue("signed") == "true"
+	}
+	processSignature(&edited, r, partial)
+	if status == "" {
+		*book = edited
+		summary = "book updated"
+	}
+	return
+}
+
+/*
+signatureFields maps the signature form fields to the details they set
+*/
+var signatureFields = map[string]func(*Signature) *string{
+	"signer":      func(s *Signature) *string { return &s.Signer },
+	"signedDate":  func(s *Signature) *string { return &s.Date },
+	"signedPlace": func(s *Signature) *string { return &s.Place },
+	"witness":     func(s *Signature) *string { return &s.Witness },
+	"certificate": func(s *Signature) *string { return &s.Certificate },
+}
+
+/*
+processSignature reads the signature details of the book from the request, partial requests
+only change the details they include. Unsigned books don't keep any details.
+*/
+func processSignature(book *Book, r *http.Request, partial bool) {
+	for field, detail := range signatureFields {
+		if _, present := r.Form[field]; present || !partial {
+			*detail(&book.Signature) = strings.TrimSpace(r.FormValue(field))
+		}
+	}
+	if !book.Signed {
+		book.Signature = Signature{}
+	}
+}
+
+/*
+processPatch updates the fields of the comic that are in the request, the key fields can only be changed by renaming
+*/
+func processPatch(ds boltq.DataStore, comic *Comic, r *http.Request) (status string) {
+	r.ParseMultipartForm(FORM_MEMORY)
+	data := PageData{}
+	for _, field := range bulkFields {
+		if _, present := r.Form[field]; present {
+			setComicField(comic, field, r.FormValue(field))
+		}
+	}
+	if _, present := r.Form["date"]; present {
+		comic.Year, comic.Month, status = processDate(r, "date", status, data)
+	}
+	if _, present := r.Form["chronOffset"]; present {
+		comic.ChronOffset, status = processInt(r, "chronOffset", status, data)
+	}
+	if _, present := r.Form["coverPrice"]; present {
+		comic.CoverPrice, status = processMoney(r, "coverPrice", status, data)
+	}
+	if _, present := r.Form["upc"]; present {
+		comic.UPC, status = processUPC(r, "upc", status, data)
+	}
+	if status == "" {
+		status = checkUPCOwner(ds, comic)
+	}
+	return
+}
+
+/*
+flashStatus saves a status message in the session to show on the next page,
+it's used when a form is redirected back to the comic
+*/
+func flashStatus(w http.ResponseWriter, r *http.Request, status string) {
+	session, _ := store.Get(r, SessionName)
+	session.AddFlash(status, STATUS_FLASH)
+	err := session.Save(r, w)
+	if err != nil {
+		log.Printf("Problem saving status: %v", err)
+	}
+}
+
+/*
+takeFlashStatus gets and clears the status message saved by flashStatus
+*/
+func takeFlashStatus(w http.ResponseWriter, r *http.Request) (status string) {
+	session, _ := store.Get(r, SessionName)
+	flashes := session.Flashes(STATUS_FLASH)
+	if len(flashes) > 0 {
+		status, _ = flashes[0].(string)
+		err := session.Save(r, w)
+		if err != nil {
+			log.Printf("Problem clearing status: %v", err)
+		}
+	}
+	return
+}
@@ -0,0 +1,316 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	BREAKDOWN_COL   = "comics_breakdown"
+	BREAKDOWN_KEY   = "collection"
+	TOP_BOOKS_COUNT = 10
+	SIGNED_NAME     = "signed"
+	UNSIGNED_NAME   = "unsigned"
+	UNGRADED_BAND   = "ungraded"
+	UNKNOWN_SIGNER  = "unknown signer"
+)
+
+/* gradeBand groups individual grades into coarser bands for totals */
+var gradeBand = map[string]string{
+	POOR:      "low grade (PR-GD)",
+	FAIR:      "low grade (PR-GD)",
+	GOOD:      "low grade (PR-GD)",
+	VERY_GOOD: "mid grade (VG-FN)",
+	FINE:      "mid grade (VG-FN)",
+	VERY_FINE: "high grade (VF-NM)",
+	NEAR_MINT: "high grade (VF-NM)",
+}
+
+/* bandRank orders the grade bands from worst to best */
+var bandRank = map[string]int{
+	"low grade (PR-GD)":  0,
+	"mid grade (VG-FN)":  1,
+	"high grade (VF-NM)": 2,
+	UNGRADED_BAND:        3,
+}
+
+/*
+GroupTotal holds total count and value for an arbitrary grouping of books
+*/
+type GroupTotal struct {
+	Name  string
+	Count int
+	Value int
+}
+
+/*
+FormatValue formats the group total value as a currency string
+*/
+func (gt GroupTotal) FormatValue() string {
+	return FormatCurrency(gt.Value)
+}
+
+/*
+TopBook is a single physical copy along with the comic details needed to display it
+*/
+type TopBook struct {
+	SeriesId string
+	Title    string
+	Issue    string
+	CoverId  string
+	Path     string
+	Grade    string
+	Value    int
+	Signed   bool
+	Signer   string
+}
+
+/*
+FormatValue formats the book value as a currency string
+*/
+func (tb TopBook) FormatValue() string {
+	return FormatCurrency(tb.Value)
+}
+
+/*
+FormatIssue formats the issue number for display
+*/
+func (tb TopBook) FormatIssue() string {
+	return TrimIssue(tb.Issue, false)
+}
+
+/*
+TotalsBreakdown holds collection wide rollups that aren't grouped by series
+*/
+type TotalsBreakdown struct {
+	Publishers []GroupTotal
+	Years      []GroupTotal
+	Grades     []GroupTotal
+	Signed     []GroupTotal
+	Signers    []GroupTotal
+	TopBooks   []TopBook
+	UpToDate   bool
+}
+
+/*
+groupTotals accumulates counts and values keyed by group name
+*/
+type groupTotals map[string]*GroupTotal
+
+func (gt groupTotals) add(name string, value int) {
+	total, found := gt[name]
+	if !found {
+		total = &GroupTotal{Name: name}
+		gt[name] = total
+	}
+	total.Count += 1
+	total.Value += value
+}
+
+/*
+sorted returns the group totals ordered using the less function on group names
+*/
+func (gt groupTotals) sorted(less func(a, b string) bool) []GroupTotal {
+	rval := make([]GroupTotal, 0, len(gt))
+	for _, total := range gt {
+		rval = append(rval, *total)
+	}
+	sort.Sort(groupTotalSorter{rval, less})
+	return rval
+}
+
+/*
+groupTotalSorter sorts group totals by name using a custom comparison
+*/
+type groupTotalSorter struct {
+	totals []GroupTotal
+	less   func(a, b string) bool
+}
+
+/*
+see Sort interface
+*/
+func (s groupTotalSorter) Len() int {
+	return len(s.totals)
+}
+
+/*
+see Sort interface
+*/
+func (s groupTotalSorter) Less(i, j int) bool {
+	return s.less(s.totals[i].Name, s.totals[j].Name)
+}
+
+/*
+see Sort interface
+*/
+func (s groupTotalSorter) Swap(i, j int) {
+	s.totals[i], s.totals[j] = s.totals[j], s.totals[i]
+}
+
+func byName(a, b string) bool {
+	return a < b
+}
+
+func byBand(a, b string) bool {
+	return bandRank[a] < bandRank[b]
+}
+
+/*
+TopBookList is a list of books sortable by descending value
+*/
+type TopBookList []TopBook
+
+/*
+see Sort interface
+*/
+func (tl TopBookList) Len() int {
+	return len(tl)
+}
+
+/*
+see Sort interface
+*/
+func (tl TopBookList) Less(i, j int) bool {
+	return tl[i].Value > tl[j].Value
+}
+
+/*
+see Sort interface
+*/
+func (tl TopBookList) Swap(i, j int) {
+	tl[i], tl[j] = tl[j], tl[i]
+}
+
+/*
+GradeBand returns the display name of the band that the grade falls in
+*/
+func GradeBand(grade string) string {
+	band, found := gradeBand[grade]
+	if !found {
+		band = UNGRADED_BAND
+	}
+	return band
+}
+
+/*
+getTotalsBreakdown gets the collection wide rollups.
+Stale rollups are returned as is, they are recalculated by the totals worker.
+*/
+func getTotalsBreakdown(ds boltq.DataStore) (breakdown TotalsBreakdown, err error) {
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(BREAKDOWN_COL))
+		if b != nil {
+			serialized := b.Get([]byte(BREAKDOWN_KEY))
+			if serialized != nil {
+				e = json.Unmarshal(serialized, &breakdown)
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+txRecalculateBreakdown recalculates the collection wide rollups if they are out of date
+*/
+func txRecalculateBreakdown(tx *bolt.Tx) error {
+	var breakdown TotalsBreakdown
+	b, e := tx.CreateBucketIfNotExists([]byte(BREAKDOWN_COL))
+	if e == nil {
+		serialized := b.Get([]byte(BREAKDOWN_KEY))
+		if serialized != nil {
+			e = json.Unmarshal(serialized, &breakdown)
+		}
+	}
+	if e == nil && !breakdown.UpToDate {
+		breakdown, e = calculateTotalsBreakdown(tx)
+		if e == nil {
+			e = storeBreakdown(b, breakdown)
+		}
+	}
+	return e
+}
+
+func storeBreakdown(b *bolt.Bucket, breakdown TotalsBreakdown) error {
+	v, err := json.Marshal(&breakdown)
+	if err == nil {
+		err = b.Put([]byte(BREAKDOWN_KEY), v)
+	}
+	return err
+}
+
+/*
+calculateTotalsBreakdown scans every comic in the collection and builds the rollups
+*/
+func calculateTotalsBreakdown(tx *bolt.Tx) (TotalsBreakdown, error) {
+	var breakdown TotalsBreakdown
+	publishers := make(groupTotals)
+	years := make(groupTotals)
+	grades := make(groupTotals)
+	signed := make(groupTotals)
+	signers := make(groupTotals)
+	var top TopBookList
+
+	q := boltq.NewQuery([]byte(COMIC_COL), boltq.Any())
+	results, err := boltq.TxQuery(tx, q)
+	for i := 0; err == nil && i < len(results); i += 1 {
+		var comic Comic
+		err = json.Unmarshal(results[i], &comic)
+		if err == nil {
+			for j := range comic.Books {
+				book := comic.Books[j]
+				publishers.add(comic.Publisher, book.Value)
+				years.add(strconv.Itoa(comic.Year), book.Value)
+				grades.add(GradeBand(book.Grade), book.Value)
+				if book.Signed {
+					signed.add(SIGNED_NAME, book.Value)
+					signers.add(book.FormatSigner(), book.Value)
+				} else {
+					signed.add(UNSIGNED_NAME, book.Value)
+				}
+				top = append(top, TopBook{comic.SeriesId, comic.Title, comic.Issue,
+					comic.CoverId, comic.FullPath(), book.Grade, book.Value, book.Signed,
+					book.Signature.Signer})
+			}
+		}
+	}
+
+	if err == nil {
+		sort.Stable(top)
+		if len(top) > TOP_BOOKS_COUNT {
+			top = top[:TOP_BOOKS_COUNT]
+		}
+		breakdown.Publishers = publishers.sorted(byName)
+		breakdown.Years = years.sorted(byName)
+		breakdown.Grades = grades.sorted(byBand)
+		breakdown.Signed = signed.sorted(byName)
+		breakdown.Signers = signers.sorted(byName)
+		breakdown.TopBooks = top
+		breakdown.UpToDate = true
+	}
+	return breakdown, err
+}
+
+/*
+TxUpdateTotalsBreakdown updates the dirty flag for the collection wide rollups
+*/
+func TxUpdateTotalsBreakdown(tx *bolt.Tx) error {
+	var breakdown TotalsBreakdown
+	b, e := tx.CreateBucketIfNotExists([]byte(BREAKDOWN_COL))
+	if e == nil {
+		serialized := b.Get([]byte(BREAKDOWN_KEY))
+		if serialized != nil {
+			e = json.Unmarshal(serialized, &breakdown)
+		}
+	}
+	if e == nil {
+		breakdown.UpToDate = false
+		e = storeBreakdown(b, breakdown)
+	}
+	return e
+}
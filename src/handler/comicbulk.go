@@ -0,0 +1,467 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/* bulk edits keyed by id, each keeps the comics as they were so the edit can be undone */
+	BULK_COL = "comics.bulk"
+	/* number of recent bulk edits listed on the bulk edit page */
+	BULK_HISTORY_COUNT = 10
+)
+
+/*
+bulkFields are the text fields of the upload form that can be set across several comics
+*/
+var bulkFields = []string{"publisher", "title", "subtitle", "author", "coverArtist",
+	"pencils", "inks", "colors", "letters", "notes"}
+
+/*
+BulkChanges are the changes applied to every comic in a bulk edit
+*/
+type BulkChanges struct {
+	/* upload form field names to new values, empty fields aren't changed */
+	Fields map[string]string
+	/* book added to every comic, nil for none */
+	Book       *Book
+	ClearBooks bool
+}
+
+/*
+BulkComic records what a bulk edit changed on one comic so only those changes are undone
+*/
+type BulkComic struct {
+	Ref string
+	/* values of the changed fields before the edit */
+	Fields map[string]string
+	/* books removed by clearing, they get their ids back on undo */
+	Books []Book
+	/* id of the book added by the edit, 0 for none */
+	BookId int
+}
+
+/*
+BulkEdit records a bulk edit so it can be listed and undone
+*/
+type BulkEdit struct {
+	Id      int
+	Editor  string
+	Time    time.Time
+	Summary string
+	Changes BulkChanges
+	Comics  []BulkComic
+	Undone  bool
+}
+
+func (be *BulkEdit) FormatTime() string {
+	return be.Time.Format("2006-01-02 15:04")
+}
+
+/*
+Ref identifies the comic in forms that select several comics
+*/
+func (comic *Comic) Ref() string {
+	key := comic.CreateKey()
+	return fmt.Sprintf("%s/%s/%s", key[0], key[1], key[2])
+}
+
+/*
+parseComicRef splits a reference created by Comic.Ref into the comic key
+*/
+func parseComicRef(ref string) ([][]byte, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid comic reference %v", ref)
+	}
+	return [][]byte{[]byte(parts[0]), []byte(parts[1]), []byte(parts[2])}, nil
+}
+
+/*
+comicField gets a text field of the comic by its upload form name, nil for unknown fields
+*/
+func comicField(comic *Comic, field string) *string {
+	switch field {
+	case "publisher":
+		return &comic.Publisher
+	case "title":
+		return &comic.Title
+	case "subtitle":
+		return &comic.Subtitle
+	case "author":
+		return &comic.Author
+	case "coverArtist":
+		return &comic.CoverArtist
+	case "pencils":
+		return &comic.Pencils
+	case "inks":
+		return &comic.Inks
+	case "colors":
+		return &comic.Colors
+	case "letters":
+		return &comic.Letters
+	case "notes":
+		return &comic.Notes
+	}
+	return nil
+}
+
+/*
+setComicField sets a text field of the comic by its upload form name
+*/
+func setComicField(comic *Comic, field, value string) {
+	if f := comicField(comic, field); f != nil {
+		*f = value
+	}
+}
+
+/*
+apply makes the changes to the comic, books are cleared before the new book is added.
+The returned record has what the changes replaced, the added book id is filled in once the comic is stored.
+*/
+func (bc BulkChanges) apply(comic *Comic) BulkComic {
+	record := BulkComic{Ref: comic.Ref(), Fields: make(map[string]string)}
+	for _, field := range bulkFields {
+		value, changed := bc.Fields[field]
+		if changed {
+			record.Fields[field] = *comicField(comic, field)
+			setComicField(comic, field, value)
+		}
+	}
+	if bc.ClearBooks {
+		record.Books = comic.Books
+		comic.Books = nil
+	}
+	if bc.Book != nil {
+		/* copy so the comic recorded in the history keeps its books */
+		books := make([]Book, len(comic.Books), len(comic.Books)+1)
+		copy(books, comic.Books)
+		comic.Books = append(books, *bc.Book)
+	}
+	return record
+}
+
+/*
+undo reverses the changes recorded for the comic. Fields that were edited again since the bulk edit
+keep their newer value and books added or removed since are left alone.
+*/
+func (bc BulkChanges) undo(comic *Comic, record BulkComic) {
+	for field, old := range record.Fields {
+		if f := comicField(comic, field); f != nil && *f == bc.Fields[field] {
+			*f = old
+		}
+	}
+	if index := comic.BookIndex(record.BookId); record.BookId != 0 && index >= 0 {
+		comic.Books = append(comic.Books[:index:index], comic.Books[index+1:]...)
+	}
+	var restored []Book
+	for _, book := range record.Books {
+		if comic.BookIndex(book.Id) < 0 {
+			restored = append(restored, book)
+		}
+	}
+	if restored != nil {
+		comic.Books = append(restored, comic.Books...)
+	}
+}
+
+/*
+describe summarizes the changes for the history
+*/
+func (bc BulkChanges) describe() string {
+	var parts []string
+	for _, field := range bulkFields {
+		if value, changed := bc.Fields[field]; changed {
+			parts = append(parts, fmt.Sprintf("%v set to %v", field, value))
+		}
+	}
+	if bc.ClearBooks {
+		parts = append(parts, "books cleared")
+	}
+	if bc.Book != nil {
+		parts = append(parts, fmt.Sprintf("added %v book", bc.Book.Grade))
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+txWriteComic stores and indexes the comic inside the transaction, the history records the changes from prev.
+The missing index and totals are updated too since bulk changes can add or clear books.
+*/
+func txWriteComic(tx *bolt.Tx, key [][]byte, comic, prev *Comic, editor, summary string) error {
+	err := txStoreComic(tx, key, comic, prev, editor, summary)
+	if err == nil {
+		err = TxUpdateMissingIndex(tx, *comic)
+	}
+	if err == nil {
+		err = TxUpdateComicTotals(tx, comic.SeriesId)
+	}
+	return err
+}
+
+/*
+txStoreBulkEdit saves the bulk edit under its id
+*/
+func txStoreBulkEdit(tx *bolt.Tx, edit *BulkEdit) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(BULK_COL))
+	var encoded []byte
+	if err == nil {
+		encoded, err = json.Marshal(edit)
+	}
+	if err == nil {
+		err = b.Put(versionKey(edit.Id), encoded)
+	}
+	return err
+}
+
+/*
+applyBulkEdit makes the changes to every referenced comic in a single transaction,
+if any comic can't be updated none of them are
+*/
+func applyBulkEdit(ds boltq.DataStore, refs []string, changes BulkChanges, editor string) (edit BulkEdit, err error) {
+	err = ds.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(BULK_COL))
+		var seq uint64
+		if e == nil {
+			seq, e = b.NextSequence()
+		}
+		edit = BulkEdit{Id: int(seq), Editor: editor, Time: time.Now(), Changes: changes}
+		edit.Summary = fmt.Sprintf("bulk edit %d: %v", edit.Id, changes.describe())
+		for i := 0; e == nil && i < len(refs); i += 1 {
+			var key [][]byte
+			var comic Comic
+			var found bool
+			key, e = parseComicRef(refs[i])
+			if e == nil {
+				comic, found, e = txGetComic(tx, key)
+			}
+			if e == nil && !found {
+				e = fmt.Errorf("Unable to find comic: %v", formatKeys(key))
+			}
+			if e == nil {
+				prev := comic
+				record := changes.apply(&comic)
+				e = txWriteComic(tx, key, &comic, &prev, editor, edit.Summary)
+				if changes.Book != nil {
+					record.BookId = comic.Books[len(comic.Books)-1].Id
+				}
+				edit.Comics = append(edit.Comics, record)
+			}
+		}
+		if e == nil {
+			e = txStoreBulkEdit(tx, &edit)
+		}
+		return e
+	})
+	if err == nil {
+		GetTotalsWorker(ds).Trigger()
+	}
+	return
+}
+
+/*
+undoBulkEdit reverses the changes the bulk edit made to each comic, later changes to the comics are kept.
+Comics that were since deleted or renamed are skipped.
+*/
+func undoBulkEdit(ds boltq.DataStore, id int, editor string) (restored int, err error) {
+	err = ds.Update(func(tx *bolt.Tx) error {
+		var edit BulkEdit
+		b := tx.Bucket([]byte(BULK_COL))
+		var encoded []byte
+		if b != nil {
+			encoded = b.Get(versionKey(id))
+		}
+		if encoded == nil {
+			return fmt.Errorf("Unable to find bulk edit %d", id)
+		}
+		e := json.Unmarshal(encoded, &edit)
+		if e == nil && edit.Undone {
+			e = fmt.Errorf("Bulk edit %d was already undone", id)
+		}
+		summary := fmt.Sprintf("undid bulk edit %d", id)
+		for i := 0; e == nil && i < len(edit.Comics); i += 1 {
+			var key [][]byte
+			var current Comic
+			var found bool
+			key, e = parseComicRef(edit.Comics[i].Ref)
+			if e == nil {
+				current, found, e = txGetComic(tx, key)
+			}
+			if e == nil && found {
+				comic := current
+				comic.Books = append([]Book(nil), current.Books...)
+				edit.Changes.undo(&comic, edit.Comics[i])
+				e = txWriteComic(tx, key, &comic, &current, editor, summary)
+				restored += 1
+			}
+		}
+		if e == nil {
+			edit.Undone = true
+			e = txStoreBulkEdit(tx, &edit)
+		}
+		return e
+	})
+	if err == nil {
+		GetTotalsWorker(ds).Trigger()
+	} else {
+		restored = 0
+	}
+	return
+}
+
+/*
+getBulkEdits gets up to count of the most recent bulk edits, newest first
+*/
+func getBulkEdits(ds boltq.DataStore, count int) (edits []BulkEdit, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BULK_COL))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var e error
+		for k, v := c.Last(); e == nil && k != nil && len(edits) < count; k, v = c.Prev() {
+			var edit BulkEdit
+			e = json.Unmarshal(v, &edit)
+			if e == nil {
+				edits = append(edits, edit)
+			}
+		}
+		return e
+	})
+	return
+}
+
+/*
+processBulkEdit reads the changes from the bulk edit form and applies them to the selected comics
+*/
+func processBulkEdit(ds boltq.DataStore, r *http.Request, refs []string, data PageData) string {
+	if len(refs) == 0 {
+		return "No comics selected"
+	}
+	var status string
+	changes := BulkChanges{Fields: make(map[string]string)}
+	for _, field := range bulkFields {
+		value := strings.TrimSpace(r.FormValue(field))
+		if value != "" {
+			changes.Fields[field] = value
+			data[field] = value
+		}
+	}
+	changes.ClearBooks = r.FormValue("clearBooks") == "true"
+	if r.FormValue("grade") != "" {
+		var book Book
+		book.Grade, status = processGrade(r, "grade", status, data)
+		book.Value, status = processMoney(r, "value", status, data)
+		book.Signed = r.FormValue("signed") == "true"
+		changes.Book = &book
+	}
+	if status != "" {
+		return status
+	}
+	if len(changes.Fields) == 0 && changes.Book == nil && !changes.ClearBooks {
+		return "No changes entered"
+	}
+	edit, err := applyBulkEdit(ds, refs, changes, editorOf(r))
+	if err != nil {
+		return fmt.Sprintf("Unable to apply bulk edit: %v", err.Error())
+	}
+	return fmt.Sprintf("Bulk edit %d applied to %d comics", edit.Id, len(edit.Comics))
+}
+
+/*
+processBulkUndo undoes the bulk edit selected on the bulk edit page
+*/
+func processBulkUndo(ds boltq.DataStore, r *http.Request) string {
+	id, err := strconv.Atoi(r.FormValue("edit"))
+	if err != nil {
+		return "Unknown bulk edit"
+	}
+	restored, err := undoBulkEdit(ds, id, editorOf(r))
+	if err != nil {
+		return fmt.Sprintf("Unable to undo bulk edit: %v", err.Error())
+	}
+	return fmt.Sprintf("Bulk edit %d undone, %d comics restored", id, restored)
+}
+
+/*
+ComicBulkHandler handles requests to edit several comics at once
+*/
+type ComicBulkHandler struct {
+	loginTemplate   *template.Template
+	blockedTemplate *template.Template
+	bulkTemplate    *template.Template
+	ds              boltq.DataStore
+}
+
+/*
+ComicsBulk creates a new ComicBulkHandler
+*/
+func ComicsBulk(db *bolt.DB, webroot string) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	bulk := CreateTemplate(webroot, "base.html", "comicbulk.template")
+	ds := boltq.DataStore{db}
+	return &Wrapper{ComicBulkHandler{login, block, bulk, ds}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicBulkHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "ComicUploader", "")
+	if authorized && templateErr == nil {
+		r.ParseForm()
+		refs := r.Form["comics"]
+		var status string
+		if r.Method == "POST" {
+			action := r.FormValue("action")
+			if action == "apply" {
+				status = processBulkEdit(h.ds, r, refs, data)
+			} else if action == "undo" {
+				status = processBulkUndo(h.ds, r)
+			}
+		}
+		var selected []Comic
+		for _, ref := range refs {
+			key, err := parseComicRef(ref)
+			var comic Comic
+			var found bool
+			if err == nil {
+				comic, found, err = getComic(h.ds, key)
+			}
+			if err != nil {
+				log.Printf("Problem getting selected comic %v: %v", ref, err)
+			} else if found {
+				selected = append(selected, comic)
+			}
+		}
+		edits, err := getBulkEdits(h.ds, BULK_HISTORY_COUNT)
+		if err != nil {
+			log.Printf("Problem getting bulk edits: %v", err)
+		}
+		data["Status"] = status
+		data["Selected"] = selected
+		data["Edits"] = edits
+		templateErr = h.bulkTemplate.Execute(w, data)
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return nil
+}
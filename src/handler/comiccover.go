@@ -2,23 +2,27 @@ package handler
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
+	_ "image/gif"
 	"io"
-	"mime/multipart"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/bclement/boltq"
 	"github.com/boltdb/bolt"
-	"github.com/nfnt/resize"
 )
 
 type FileStorer interface {
@@ -26,6 +30,58 @@ type FileStorer interface {
 	   Store persists the file using the supplied path
 	*/
 	Store(contentType, dirName, fileName string, file io.ReadSeeker, size int64) error
+	/*
+	   Load opens the file stored at the supplied path, the caller must close it
+	*/
+	Load(dirName, fileName string) (io.ReadCloser, StoredFileInfo, error)
+	/*
+	   List returns the paths of all files under the directory, including subdirectories
+	*/
+	List(dirName string) ([]string, error)
+	/*
+	   Delete removes the file stored at the supplied path
+	*/
+	Delete(dirName, fileName string) error
+}
+
+/*
+StoredFileInfo holds metadata about a file in a FileStorer
+*/
+type StoredFileInfo struct {
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+/*
+IsNotFound returns true if the error from a FileStorer means the file doesn't exist
+*/
+func IsNotFound(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == "NoSuchKey" || awsErr.Code() == "NotFound")
+}
+
+/*
+NewFileStorer creates the local or S3 file storer depending on the local flag
+*/
+func NewFileStorer(ds boltq.DataStore, webroot string, local bool) FileStorer {
+	var storer FileStorer
+	if local {
+		storer = NewLocalStore(webroot)
+	} else {
+		var err error
+		storer, err = NewS3Store(ds)
+		if err != nil {
+			log.Printf("Problem creating S3 file store: %v\n", err)
+		}
+	}
+	return storer
 }
 
 /*
@@ -39,14 +95,32 @@ func NewLocalStore(webroot string) LocalStore {
 	return LocalStore{webroot}
 }
 
+/*
+isPrivateDir returns true for directories that must only be served by a handler that checks the user,
+they are kept out of the static tree and aren't readable by anyone with the S3 url
+*/
+func isPrivateDir(dirName string) bool {
+	first := strings.Split(filepath.ToSlash(filepath.Clean(dirName)), "/")[0]
+	return first == DIGITAL_DIR
+}
+
+/*
+root returns the local directory that files in dirName are stored under
+*/
+func (ls LocalStore) root(dirName string) string {
+	if isPrivateDir(dirName) {
+		return filepath.Join(ls.webroot, "private", "comics")
+	}
+	return filepath.Join(ls.webroot, "static", "comics")
+}
+
 /*
 see FIleStorer interface
 */
 func (ls LocalStore) Store(contentType, dirName, fileName string,
 	file io.ReadSeeker, size int64) (err error) {
 
-	dirPath := filepath.Join("static", "comics", dirName)
-	absPath := filepath.Join(ls.webroot, dirPath)
+	absPath := filepath.Join(ls.root(dirName), dirName)
 	err = os.MkdirAll(absPath, 0700)
 	if err == nil {
 		cfilePath := filepath.Join(absPath, fileName)
@@ -55,52 +129,217 @@ func (ls LocalStore) Store(contentType, dirName, fileName string,
 	return
 }
 
+/*
+see FileStorer interface
+*/
+func (ls LocalStore) Load(dirName, fileName string) (file io.ReadCloser,
+	info StoredFileInfo, err error) {
+
+	absPath := filepath.Join(ls.root(dirName), dirName, fileName)
+	var f *os.File
+	f, err = os.Open(absPath)
+	if err == nil {
+		var stat os.FileInfo
+		stat, err = f.Stat()
+		if err == nil {
+			info.Size = stat.Size()
+			info.ModTime = stat.ModTime()
+			info.ContentType = mime.TypeByExtension(filepath.Ext(fileName))
+			file = f
+		} else {
+			f.Close()
+		}
+	}
+	return
+}
+
+/*
+see FileStorer interface
+*/
+func (ls LocalStore) List(dirName string) (paths []string, err error) {
+	root := ls.root(dirName)
+	absPath := filepath.Join(root, dirName)
+	err = filepath.Walk(absPath, func(p string, info os.FileInfo, e error) error {
+		if e == nil && !info.IsDir() {
+			var rel string
+			rel, e = filepath.Rel(root, p)
+			paths = append(paths, rel)
+		}
+		return e
+	})
+	if os.IsNotExist(err) {
+		/* nothing has been stored there yet */
+		err = nil
+	}
+	return
+}
+
+/*
+see FileStorer interface
+*/
+func (ls LocalStore) Delete(dirName, fileName string) error {
+	absPath := filepath.Join(ls.root(dirName), dirName, fileName)
+	return os.Remove(absPath)
+}
+
+const (
+	AWS_CONFIG_COL = "aws.config"
+	CREDS_SHARED   = "shared"
+	CREDS_ENV      = "env"
+	CREDS_STATIC   = "static"
+	/* acl value used to skip sending an ACL, some S3 compatible stores don't support them */
+	ACL_NONE = "none"
+	/* acl for files in private directories, stores without ACLs rely on the bucket policy */
+	ACL_PRIVATE = "private"
+)
+
+/*
+S3Config holds the connection settings for an S3 or S3 compatible store
+*/
+type S3Config struct {
+	Bucket          string
+	CoverDir        string
+	ThumbDir        string
+	Endpoint        string
+	Region          string
+	PathStyle       bool
+	DisableSSL      bool
+	ACL             string
+	CredsSource     string
+	CredsFile       string
+	CredsProfile    string
+	AccessKeyId     string
+	SecretAccessKey string
+	KeyPrefix       string
+}
+
 type S3Store struct {
-	client   *s3.S3
-	bucket   string
-	coverDir string
-	thumbDir string
+	client    *s3.S3
+	bucket    string
+	coverDir  string
+	thumbDir  string
+	acl       string
+	keyPrefix string
 }
 
+/*
+NewS3Store creates an S3Store using the config in the db
+*/
 func NewS3Store(ds boltq.DataStore) (s S3Store, err error) {
-	var awsBucket string
-	var credsFile string
-	var coverDir string
-	var thumbDir string
+	var config S3Config
+	config, err = GetS3Config(ds, AWS_CONFIG_COL)
+	if err == nil {
+		s, err = NewS3StoreFromConfig(config)
+	}
+	return
+}
+
+/*
+GetS3Config reads S3 settings from the named config bucket in the db.
+Settings that aren't found use the defaults for Amazon S3.
+*/
+func GetS3Config(ds boltq.DataStore, bucketName string) (config S3Config, err error) {
 	err = ds.View(func(tx *bolt.Tx) (e error) {
-		b := tx.Bucket([]byte("aws.config"))
+		b := tx.Bucket([]byte(bucketName))
 		if b != nil {
-			awsBucket = getStringFromBucket(b, "bucket")
-			coverDir = getStringFromBucket(b, "coverDir")
-			thumbDir = getStringFromBucket(b, "thumbDir")
-			credsFile = getStringFromBucket(b, "credsFile")
+			config.Bucket = getStringFromBucket(b, "bucket")
+			config.CoverDir = getStringFromBucket(b, "coverDir")
+			config.ThumbDir = getStringFromBucket(b, "thumbDir")
+			config.Endpoint = getStringFromBucket(b, "endpoint")
+			config.Region = getStringFromBucket(b, "region")
+			config.PathStyle = getStringFromBucket(b, "pathStyle") != "false"
+			config.DisableSSL = getStringFromBucket(b, "disableSSL") == "true"
+			config.ACL = getStringFromBucket(b, "acl")
+			config.CredsSource = getStringFromBucket(b, "credsSource")
+			config.CredsFile = getStringFromBucket(b, "credsFile")
+			config.CredsProfile = getStringFromBucket(b, "credsProfile")
+			config.AccessKeyId = getStringFromBucket(b, "accessKeyId")
+			config.SecretAccessKey = getStringFromBucket(b, "secretAccessKey")
+			config.KeyPrefix = getStringFromBucket(b, "keyPrefix")
 		} else {
-			e = fmt.Errorf("Unable to find config bucket: aws.config")
+			e = fmt.Errorf("Unable to find config bucket: %v", bucketName)
 		}
 		return
 	})
-	if err == nil {
-		if awsBucket == "" || credsFile == "" || coverDir == "" || thumbDir == "" {
-			err = fmt.Errorf("Unable to find all config params in db")
+	if config.Endpoint == "" {
+		config.Endpoint = "s3.amazonaws.com"
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.ACL == "" {
+		config.ACL = "public-read"
+	}
+	if config.CredsSource == "" {
+		config.CredsSource = CREDS_SHARED
+	}
+	if config.CredsProfile == "" {
+		config.CredsProfile = "default"
+	}
+	return
+}
+
+/*
+getCredentials creates the credentials provider for the configured source
+*/
+func (config S3Config) getCredentials() (creds *credentials.Credentials, err error) {
+	switch config.CredsSource {
+	case CREDS_SHARED:
+		if config.CredsFile == "" {
+			err = fmt.Errorf("Missing credsFile for shared credentials")
 		} else {
-			creds := credentials.NewSharedCredentials(credsFile, "default")
-			_, err = creds.Get()
-			if err == nil {
-				config := &aws.Config{
-					Region:           aws.String("us-east-1"),
-					Endpoint:         aws.String("s3.amazonaws.com"),
-					S3ForcePathStyle: aws.Bool(true),
-					Credentials:      creds,
-					LogLevel:         aws.LogLevel(0),
-				}
-				client := s3.New(config)
-				s = S3Store{client, awsBucket, coverDir, thumbDir}
-			}
+			creds = credentials.NewSharedCredentials(config.CredsFile, config.CredsProfile)
+		}
+	case CREDS_ENV:
+		creds = credentials.NewEnvCredentials()
+	case CREDS_STATIC:
+		if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+			err = fmt.Errorf("Missing accessKeyId or secretAccessKey for static credentials")
+		} else {
+			creds = credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, "")
+		}
+	default:
+		err = fmt.Errorf("Unknown credentials source: %v", config.CredsSource)
+	}
+	if err == nil {
+		_, err = creds.Get()
+	}
+	return
+}
+
+/*
+NewS3StoreFromConfig creates an S3Store that connects using the provided settings
+*/
+func NewS3StoreFromConfig(config S3Config) (s S3Store, err error) {
+	if config.Bucket == "" || config.CoverDir == "" || config.ThumbDir == "" {
+		err = fmt.Errorf("Unable to find all config params in db")
+		return
+	}
+	var creds *credentials.Credentials
+	creds, err = config.getCredentials()
+	if err == nil {
+		awsConfig := &aws.Config{
+			Region:           aws.String(config.Region),
+			Endpoint:         aws.String(config.Endpoint),
+			S3ForcePathStyle: aws.Bool(config.PathStyle),
+			DisableSSL:       aws.Bool(config.DisableSSL),
+			Credentials:      creds,
+			LogLevel:         aws.LogLevel(0),
 		}
+		client := s3.New(awsConfig)
+		s = S3Store{client, config.Bucket, config.CoverDir, config.ThumbDir,
+			config.ACL, config.KeyPrefix}
 	}
 	return
 }
 
+/*
+objectKey creates the full object key for a file including any configured prefix
+*/
+func (s S3Store) objectKey(dirName, fileName string) string {
+	return path.Join(s.keyPrefix, dirName, fileName)
+}
+
 func getStringFromBucket(b *bolt.Bucket, key string) (value string) {
 	bytes := b.Get([]byte(key))
 	if bytes != nil {
@@ -115,15 +354,22 @@ see FileStorer interface
 func (s S3Store) Store(contentType, dirName, fileName string,
 	file io.ReadSeeker, size int64) (err error) {
 
-	key := filepath.Join(dirName, fileName)
+	key := s.objectKey(dirName, fileName)
 	params := &s3.PutObjectInput{
 		Bucket:        aws.String(s.bucket), // Required
 		Key:           aws.String(key),      // Required
-		ACL:           aws.String("public-read"),
 		Body:          file,
 		ContentLength: aws.Int64(size),
 	}
 
+	if s.acl != ACL_NONE {
+		acl := s.acl
+		if isPrivateDir(dirName) {
+			acl = ACL_PRIVATE
+		}
+		params.ACL = aws.String(acl)
+	}
+
 	if contentType != "" {
 		params.ContentType = aws.String(contentType)
 	}
@@ -132,90 +378,243 @@ func (s S3Store) Store(contentType, dirName, fileName string,
 	return
 }
 
-func getFileSize(f multipart.File, h *multipart.FileHeader) (size int64, err error) {
-	contentLenString := getHeaderValue(h, "Content-Length")
-	if contentLenString == "" {
-		/* second arg as 2 means offset is from the end */
-		size, err = f.Seek(0, 2)
+/*
+see FileStorer interface
+*/
+func (s S3Store) List(dirName string) (paths []string, err error) {
+	prefix := s.objectKey(dirName, "") + "/"
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	more := true
+	for err == nil && more {
+		var resp *s3.ListObjectsOutput
+		resp, err = s.client.ListObjects(params)
 		if err == nil {
-			_, err = f.Seek(0, 0)
+			var last string
+			for _, obj := range resp.Contents {
+				if obj.Key != nil {
+					last = *obj.Key
+					rel := strings.TrimPrefix(last, s.keyPrefix)
+					paths = append(paths, strings.TrimPrefix(rel, "/"))
+				}
+			}
+			more = resp.IsTruncated != nil && *resp.IsTruncated && last != ""
+			if resp.NextMarker != nil {
+				params.Marker = resp.NextMarker
+			} else {
+				params.Marker = aws.String(last)
+			}
 		}
-	} else {
-		size, err = strconv.ParseInt(contentLenString, 0, 64)
 	}
 	return
 }
 
-func getHeaderValue(h *multipart.FileHeader, key string) (value string) {
-	return h.Header.Get(key)
+/*
+see FileStorer interface
+*/
+func (s S3Store) Delete(dirName, fileName string) (err error) {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(dirName, fileName)),
+	}
+	_, err = s.client.DeleteObject(params)
+	return
+}
+
+/*
+see FileStorer interface
+*/
+func (s S3Store) Load(dirName, fileName string) (file io.ReadCloser,
+	info StoredFileInfo, err error) {
+
+	key := s.objectKey(dirName, fileName)
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	var resp *s3.GetObjectOutput
+	resp, err = s.client.GetObject(params)
+	if err == nil {
+		file = resp.Body
+		if resp.ContentLength != nil {
+			info.Size = *resp.ContentLength
+		}
+		if resp.LastModified != nil {
+			info.ModTime = *resp.LastModified
+		}
+		if resp.ContentType != nil {
+			info.ContentType = *resp.ContentType
+		}
+	}
+	return
 }
 
+const (
+	COVER_LIMITS_KEY = "coverLimits"
+)
+
 /*
-processCover reads in the cover image from the request and stores the file using the storer
+CoverLimits restricts the size of uploaded cover files
 */
-func processCover(r *http.Request, comic *Comic, storer FileStorer) (coverPath, status string) {
-	formFile, headers, err := r.FormFile("cover")
+type CoverLimits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+}
+
+var defaultCoverLimits = CoverLimits{20 << 20, 10000, 10000}
+
+/*
+coverTypes maps sniffed content types that are accepted for covers to file extensions
+*/
+var coverTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+/*
+getCoverLimits gets the cover upload limits from the db config, falling back to the defaults
+*/
+func getCoverLimits(ds boltq.DataStore) CoverLimits {
+	limits := defaultCoverLimits
+	err := ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(COMIC_CONFIG_COL))
+		if b != nil {
+			encoded := b.Get([]byte(COVER_LIMITS_KEY))
+			if encoded != nil {
+				e = json.Unmarshal(encoded, &limits)
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Problem reading cover limits, using defaults: %v", err)
+		limits = defaultCoverLimits
+	}
+	return limits
+}
+
+/*
+readCoverFile reads the uploaded cover and checks that it is an acceptable image.
+The content type and extension are determined by the file contents, not the client.
+Status is empty if the file is valid.
+*/
+func readCoverFile(src io.Reader, limits CoverLimits) (data []byte, contentType, ext, status string) {
+	/* read one extra byte so we can tell if the file is over the limit */
+	data, err := ioutil.ReadAll(io.LimitReader(src, limits.MaxBytes+1))
+	if err != nil {
+		status = fmt.Sprintf("Unable to read cover file: %v", err)
+		return
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		status = fmt.Sprintf("Cover file is too large, limit is %d bytes", limits.MaxBytes)
+		return
+	}
+	contentType = http.DetectContentType(data)
+	ext, ok := coverTypes[contentType]
+	if !ok {
+		status = fmt.Sprintf("Cover file must be a JPEG, PNG or GIF image, not %v", contentType)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		status = "Unable to read cover image, the file may be damaged"
+	} else if config.Width > limits.MaxWidth || config.Height > limits.MaxHeight {
+		status = fmt.Sprintf("Cover image is %dx%d pixels, limit is %dx%d",
+			config.Width, config.Height, limits.MaxWidth, limits.MaxHeight)
+	}
+	return
+}
+
+/*
+processCover reads in the cover image from the request and stores the original
+along with all configured renditions using the storer.
+The cover fields of the comic are only updated if a new cover was stored.
+*/
+func processCover(r *http.Request, comic *Comic, storer FileStorer,
+	specs []RenditionSpec, limits CoverLimits) (uploaded bool, status string) {
+
+	formFile, _, err := r.FormFile("cover")
 	if err != nil {
 		if err == http.ErrMissingFile {
 			if comic.CoverPath == "" {
 				status = "Missing cover file"
-			} else {
-				coverPath = comic.CoverPath
 			}
 		} else {
 			status = fmt.Sprintf("Unable to save cover: %v", err.Error())
 		}
 		return
 	}
-	dotIndex := strings.LastIndex(headers.Filename, ".")
-	ext := headers.Filename[dotIndex:]
+	defer formFile.Close()
+	return storeCover(formFile, comic, storer, specs, limits)
+}
+
+/*
+storeCover reads the cover image from src, stores it with its renditions and sets the cover fields of the comic
+*/
+func storeCover(src io.Reader, comic *Comic, storer FileStorer,
+	specs []RenditionSpec, limits CoverLimits) (uploaded bool, status string) {
+
+	data, contentType, ext, status := readCoverFile(src, limits)
+	if status != "" {
+		return
+	}
 	dirName := comic.SeriesKey()
 	issuePart := comic.IssueKey()
 	coverPart := comic.CoverKey()
-	fileName := fmt.Sprintf("%v_%v%v", issuePart, coverPart, ext)
-	coverPath = filepath.Join(dirName, fileName)
+	baseName := fmt.Sprintf("%v_%v", issuePart, coverPart)
+	fileName := baseName + ext
 	fullSizePath := filepath.Join("covers", dirName)
-	thumbPath := filepath.Join("thumbs", dirName)
-	contentType := getHeaderValue(headers, "Content-Type")
-	size, err := getFileSize(formFile, headers)
-	if err == nil {
-		/* store original size */
-		err = storer.Store(contentType, fullSizePath, fileName, formFile, size)
-	}
-	if err == nil {
-		/* rewind reader to beginning */
-		_, err = formFile.Seek(0, 0)
+	img, err := decodeCover(data)
+	if err != nil {
+		status = "Unable to read cover image, the file may be damaged"
+		return
 	}
-	var thumb bytes.Buffer
+	/* store original as uploaded */
+	err = storer.Store(contentType, fullSizePath, fileName, bytes.NewReader(data), int64(len(data)))
+	var renditions []CoverRendition
 	if err == nil {
-		/* resize to make thumbnail */
-		contentType, err = makeThumb(formFile, &thumb)
-		size = int64(thumb.Len())
+		renditions, err = storeRenditions(img, specs, storer, dirName, baseName)
+		if err != nil {
+			written := []string{filepath.Join(fullSizePath, fileName)}
+			for i := range renditions {
+				written = append(written, renditions[i].Path)
+			}
+			deleteStoredFiles(storer, written, comic)
+		}
 	}
 	if err == nil {
-		/* store thumbnail */
-		r := bytes.NewReader(thumb.Bytes())
-		err = storer.Store(contentType, thumbPath, fileName, r, size)
-	}
-	if err != nil {
-		status = err.Error()
+		comic.CoverPath = filepath.Join(dirName, fileName)
+		comic.Renditions = renditions
+		comic.SpecsKey = SpecsKey(specs)
+		comic.CoverHash = FormatCoverHash(CoverHash(img))
+		uploaded = true
+	} else {
+		status = fmt.Sprintf("Unable to save cover: %v", err.Error())
 	}
 	return
 }
 
-func makeThumb(r io.Reader, w io.Writer) (contentType string, err error) {
-	var img image.Image
-	var thumbImg image.Image
-	img, _, err = image.Decode(r)
-	if err == nil {
-		/* TODO max sizes should come from config */
-		thumbImg = resize.Thumbnail(250, 1000, img, resize.Lanczos3)
-		/* TODO thumb format should come from config */
-		err = jpeg.Encode(w, thumbImg, nil)
-		contentType = "image/jpg"
+/*
+deleteStoredFiles removes files that were written for a change that failed, files the comic still uses are kept
+*/
+func deleteStoredFiles(storer FileStorer, paths []string, keep *Comic) {
+	used := make(map[string]bool)
+	for _, p := range keep.StoredPaths() {
+		used[p] = true
+	}
+	for _, p := range paths {
+		if !used[p] {
+			dirName, fileName := filepath.Split(p)
+			err := storer.Delete(dirName, fileName)
+			if err != nil {
+				log.Printf("Problem deleting unused file %v: %v", p, err)
+			}
+		}
 	}
-
-	return
 }
 
 /*
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+/*
+fakeS3 is a stand-in for an S3 compatible server that only understands path style requests
+*/
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	types   map[string]string
+	acls    map[string]string
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string][]byte),
+		types: make(map[string]string), acls: make(map[string]string)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	bucketPath := "/" + f.bucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+	switch {
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		f.types[key] = r.Header.Get("Content-Type")
+		f.acls[key] = r.Header.Get("x-amz-acl")
+	case r.Method == "GET" && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var contents bytes.Buffer
+		for _, k := range keys {
+			fmt.Fprintf(&contents, "<Contents><Key>%v</Key><Size>%d</Size></Contents>", k, len(f.objects[k]))
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+			`<ListBucketResult><Name>%v</Name><Prefix>%v</Prefix><IsTruncated>false</IsTruncated>%v</ListBucketResult>`,
+			f.bucket, prefix, contents.String())
+	case r.Method == "GET":
+		data, found := f.objects[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Write(data)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testS3Config(server *httptest.Server) S3Config {
+	return S3Config{
+		Bucket:          "covers-bucket",
+		CoverDir:        "covers",
+		ThumbDir:        "thumbs",
+		Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		Region:          "us-east-1",
+		PathStyle:       true,
+		DisableSSL:      true,
+		ACL:             "public-read",
+		CredsSource:     CREDS_STATIC,
+		AccessKeyId:     "key",
+		SecretAccessKey: "secret",
+		KeyPrefix:       "site",
+	}
+}
+
+func TestS3StoreAgainstStandIn(t *testing.T) {
+	fake := newFakeS3("covers-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := NewS3StoreFromConfig(testS3Config(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("not really a jpeg")
+	err = store.Store("image/jpeg", "covers/star_wars", "1_a.jpg", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, found := fake.objects["site/covers/star_wars/1_a.jpg"]
+	if !found || !bytes.Equal(stored, data) {
+		t.Fatalf("object not stored under the key prefix: %v", fake.objects)
+	}
+	if fake.acls["site/covers/star_wars/1_a.jpg"] != "public-read" {
+		t.Errorf("expected public-read acl, got %q", fake.acls["site/covers/star_wars/1_a.jpg"])
+	}
+
+	file, info, err := store.Load("covers/star_wars", "1_a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || !bytes.Equal(loaded, data) {
+		t.Fatalf("loaded %q, %v", loaded, err)
+	}
+	if info.ContentType != "image/jpeg" || info.Size != int64(len(data)) {
+		t.Errorf("unexpected file info %+v", info)
+	}
+
+	store.Store("image/jpeg", "thumbs/star_wars", "1_a.jpg", bytes.NewReader(data), int64(len(data)))
+	paths, err := store.List("covers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "covers/star_wars/1_a.jpg" {
+		t.Errorf("expected listing without the key prefix, got %v", paths)
+	}
+
+	err = store.Delete("covers/star_wars", "1_a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found = fake.objects["site/covers/star_wars/1_a.jpg"]; found {
+		t.Error("object not deleted")
+	}
+	if _, _, err = store.Load("covers/star_wars", "1_a.jpg"); !IsNotFound(err) {
+		t.Errorf("expected a not found error loading a deleted object, got %v", err)
+	}
+}
+
+func TestS3StoreSkipsACL(t *testing.T) {
+	fake := newFakeS3("covers-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := testS3Config(server)
+	config.ACL = ACL_NONE
+	config.KeyPrefix = ""
+	store, err := NewS3StoreFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("cover")
+	err = store.Store("image/png", "covers", "a.png", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, found := fake.acls["covers/a.png"]
+	if !found || acl != "" {
+		t.Errorf("expected the object without an acl, got %q %v", acl, fake.objects)
+	}
+}
+
+func TestS3ImgPrefixIncludesKeyPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comiccover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ds := boltq.DataStore{db}
+	err = ds.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(AWS_CONFIG_COL))
+		if e == nil {
+			e = b.Put([]byte("imgPrefix"), []byte("https://bucket.example.com/"))
+		}
+		if e == nil {
+			e = b.Put([]byte("keyPrefix"), []byte("site/"))
+		}
+		return e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, err := getS3ImgPrefix(ds)
+	if err != nil || prefix != "https://bucket.example.com/site" {
+		t.Errorf("unexpected prefix %q, %v", prefix, err)
+	}
+}
+
+func TestDigitalCopiesArePrivate(t *testing.T) {
+	fake := newFakeS3("covers-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store, err := NewS3StoreFromConfig(testS3Config(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("archive")
+	err = store.Store("application/zip", "digital/star_wars", "1_a.cbz", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl := fake.acls["site/digital/star_wars/1_a.cbz"]; acl != ACL_PRIVATE {
+		t.Errorf("expected a private acl, got %q", acl)
+	}
+
+	dir, err := ioutil.TempDir("", "comiccover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := NewLocalStore(dir)
+	err = local.Store("application/zip", "digital/star_wars", "1_a.cbz", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "static", "comics", "digital")); !os.IsNotExist(err) {
+		t.Error("digital copy stored in the static tree")
+	}
+	file, _, err := local.Load("digital/star_wars", "1_a.cbz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	paths, err := local.List(DIGITAL_DIR)
+	if err != nil || len(paths) != 1 || paths[0] != filepath.Join("digital", "star_wars", "1_a.cbz") {
+		t.Errorf("unexpected listing %v %v", paths, err)
+	}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+/*
+CreatorCredit is a comic that a creator worked on along with what they did
+*/
+type CreatorCredit struct {
+	Comic *Comic
+	Roles []string
+}
+
+/*
+SignedBook is a book signed by a creator
+*/
+type SignedBook struct {
+	Comic *Comic
+	Book  *Book
+}
+
+/*
+creatorLink is the path of the creator's page
+*/
+func creatorLink(creator string) string {
+	return "/comics/creators/" + url.PathEscape(creator)
+}
+
+/*
+CreatorLink is the path of the signer's page, it is empty for books without a known signer
+*/
+func (gt GroupTotal) CreatorLink() string {
+	if gt.Name == UNKNOWN_SIGNER {
+		return ""
+	}
+	return creatorLink(gt.Name)
+}
+
+/*
+SignerLink is the path of the page for the book's signer, it is empty if the signer isn't known
+*/
+func (b *Book) SignerLink() string {
+	if b.Signature.Signer == "" {
+		return ""
+	}
+	return creatorLink(b.Signature.Signer)
+}
+
+/*
+creditRoles returns the roles on the comic credited to the creator, whole names are matched ignoring case
+and a credit can list more than one creator
+*/
+func creditRoles(comic *Comic, creator string) (roles []string) {
+	credits := []struct {
+		role, names string
+	}{
+		{"writer", comic.Author},
+		{"cover", comic.CoverArtist},
+		{"pencils", comic.Pencils},
+		{"inks", comic.Inks},
+		{"colors", comic.Colors},
+		{"letters", comic.Letters},
+	}
+	for _, credit := range credits {
+		for _, name := range creditNames(credit.names) {
+			if strings.EqualFold(name, creator) {
+				roles = append(roles, credit.role)
+				break
+			}
+		}
+	}
+	return
+}
+
+/*
+creditNames splits a credit field into the creators it lists, names are separated by commas,
+ampersands or "and"
+*/
+func creditNames(names string) (split []string) {
+	names = strings.NewReplacer("&", ",", " and ", ",", " And ", ",", " AND ", ",").Replace(names)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			split = append(split, name)
+		}
+	}
+	return
+}
+
+/*
+findCreatorBooks finds the comics the creator is credited on and the books they signed
+*/
+func findCreatorBooks(ds boltq.DataStore, creator string) (credits []CreatorCredit,
+	signed []SignedBook, total GroupTotal, err error) {
+
+	total.Name = creator
+	sl, err := getComics(ds, newIndexQuery(ds, creator, true))
+	if err != nil {
+		return
+	}
+	sort.Sort(ByRelease{sl})
+	for _, seriesId := range sl.Keys {
+		list := sl.Map[seriesId]
+		sort.Sort(list)
+		for _, comic := range list {
+			roles := creditRoles(comic, creator)
+			if roles != nil {
+				credits = append(credits, CreatorCredit{comic, roles})
+			}
+			for i := range comic.Books {
+				book := &comic.Books[i]
+				if book.Signed && strings.EqualFold(book.Signature.Signer, creator) {
+					signed = append(signed, SignedBook{comic, book})
+					total.Count += 1
+					total.Value += book.Value
+				}
+			}
+		}
+	}
+	return
+}
+
+/*
+ComicCreatorsHandler handles requests to the creator pages
+*/
+type ComicCreatorsHandler struct {
+	creatorsTemplate *template.Template
+	creatorTemplate  *template.Template
+	ds               boltq.DataStore
+	imgPrefix        string
+}
+
+/*
+ComicsCreators creates a new ComicCreatorsHandler
+*/
+func ComicsCreators(db *bolt.DB, webroot string, local bool) *Wrapper {
+	creators := CreateTemplate(webroot, "base.html", "comiccreators.template")
+	creator := CreateTemplate(webroot, "base.html", "comiccreator.template")
+	ds := boltq.DataStore{db}
+	imgPrefix := getImgPrefix(ds, local)
+	return &Wrapper{ComicCreatorsHandler{creators, creator, ds, imgPrefix}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicCreatorsHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	var templateErr error
+	creator, creatorPresent := mux.Vars(r)["creator"]
+	if creatorPresent {
+		credits, signed, total, err := findCreatorBooks(h.ds, creator)
+		if err != nil {
+			e := fmt.Errorf("Unable to find books for %v: %v", creator, err)
+			return &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+		}
+		data["Creator"] = creator
+		data["Credits"] = credits
+		data["Signed"] = signed
+		data["SignedTotal"] = total
+		data["ImgPrefix"] = h.imgPrefix
+		templateErr = h.creatorTemplate.Execute(w, data)
+	} else if r.FormValue("creator") != "" {
+		http.Redirect(w, r, creatorLink(r.FormValue("creator")), http.StatusSeeOther)
+	} else {
+		/* signers are the only creators tracked outside the search index */
+		breakdown, err := getTotalsBreakdown(h.ds)
+		if err != nil {
+			log.Printf("Problem finding totals breakdown: %v", err)
+		}
+		var signers []GroupTotal
+		for _, signer := range breakdown.Signers {
+			if signer.CreatorLink() != "" {
+				signers = append(signers, signer)
+			}
+		}
+		data["Signers"] = signers
+		templateErr = h.creatorsTemplate.Execute(w, data)
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return nil
+}
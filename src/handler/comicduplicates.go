@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/nfnt/resize"
+)
+
+const (
+	COVER_HASH_COL = "comics_cover_hash"
+	/* max number of differing bits (out of 64) for two covers to be considered the same scan */
+	DUPLICATE_COVER_DISTANCE = 6
+)
+
+/*
+CoverHash computes a 64 bit difference hash of the image.
+Visually similar images will have hashes with a small hamming distance.
+*/
+func CoverHash(img image.Image) uint64 {
+	/* one extra column so each row yields 8 comparisons */
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := small.Bounds()
+	var hash uint64
+	for y := 0; y < 8; y += 1 {
+		for x := 0; x < 8; x += 1 {
+			left := luminance(small, bounds.Min.X+x, bounds.Min.Y+y)
+			right := luminance(small, bounds.Min.X+x+1, bounds.Min.Y+y)
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func luminance(img image.Image, x, y int) uint32 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (299*r + 587*g + 114*b) / 1000
+}
+
+/*
+FormatCoverHash formats the hash as a fixed width hex string for storage
+*/
+func FormatCoverHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+/*
+ParseCoverHash parses a hash created by FormatCoverHash
+*/
+func ParseCoverHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+/*
+hashDistance returns the number of bits that differ between the hashes
+*/
+func hashDistance(a, b uint64) int {
+	count := 0
+	for diff := a ^ b; diff != 0; diff &= diff - 1 {
+		count += 1
+	}
+	return count
+}
+
+/*
+UpdateCoverHashIndex updates the cover hash index for the comic
+*/
+func UpdateCoverHashIndex(ds boltq.DataStore, comic Comic) (err error) {
+	err = ds.Update(func(tx *bolt.Tx) error {
+		return TxUpdateCoverHashIndex(tx, comic)
+	})
+	return
+}
+
+func TxUpdateCoverHashIndex(tx *bolt.Tx, comic Comic) error {
+	serializedKey := boltq.SerializeComposite(comic.CreateKey())
+	b, err := tx.CreateBucketIfNotExists([]byte(COVER_HASH_COL))
+	if err == nil {
+		if comic.CoverHash == "" {
+			err = b.Delete(serializedKey)
+		} else {
+			err = b.Put(serializedKey, []byte(comic.CoverHash))
+		}
+	}
+	return err
+}
+
+/*
+TxDeleteCoverHash removes the comic with the given key from the cover hash index
+*/
+func TxDeleteCoverHash(tx *bolt.Tx, key [][]byte) (err error) {
+	b := tx.Bucket([]byte(COVER_HASH_COL))
+	if b != nil {
+		err = b.Delete(boltq.SerializeComposite(key))
+	}
+	return
+}
+
+/*
+hashEntry is a comic key and its cover hash from the index
+*/
+type hashEntry struct {
+	key  [][]byte
+	hash uint64
+}
+
+/*
+txReadCoverHashes reads every entry in the cover hash index
+*/
+func txReadCoverHashes(tx *bolt.Tx) (entries []hashEntry, err error) {
+	b := tx.Bucket([]byte(COVER_HASH_COL))
+	if b != nil {
+		c := b.Cursor()
+		for k, v := c.First(); err == nil && k != nil; k, v = c.Next() {
+			var entry hashEntry
+			entry.key, err = boltq.DeserializeComposite(k)
+			if err == nil {
+				entry.hash, err = ParseCoverHash(string(v))
+			}
+			if err == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return
+}
+
+/*
+checkDuplicateCover looks for other comics with a cover that is nearly identical.
+Returns a warning message or an empty string if no similar covers were found.
+*/
+func checkDuplicateCover(ds boltq.DataStore, key [][]byte, hashStr string) string {
+	var warning string
+	hash, err := ParseCoverHash(hashStr)
+	if err == nil {
+		serializedKey := string(boltq.SerializeComposite(key))
+		err = ds.View(func(tx *bolt.Tx) error {
+			entries, e := txReadCoverHashes(tx)
+			for i := 0; e == nil && i < len(entries); i += 1 {
+				entry := entries[i]
+				if string(boltq.SerializeComposite(entry.key)) == serializedKey {
+					continue
+				}
+				if hashDistance(hash, entry.hash) <= DUPLICATE_COVER_DISTANCE {
+					warning = fmt.Sprintf("Warning: cover looks like the same scan as %v",
+						formatKeys(entry.key))
+					break
+				}
+			}
+			return e
+		})
+	}
+	if err != nil {
+		log.Printf("Problem checking for duplicate covers: %v", err)
+	}
+	return warning
+}
+
+/*
+DuplicateCovers is a pair of comics that appear to have the same cover scan
+*/
+type DuplicateCovers struct {
+	First    *Comic
+	Second   *Comic
+	Distance int
+}
+
+/*
+findDuplicateCovers compares every cover hash in the index and returns the similar pairs
+*/
+func findDuplicateCovers(ds boltq.DataStore) (dups []DuplicateCovers, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		entries, e := txReadCoverHashes(tx)
+		comics := make(map[int]*Comic)
+		for i := 0; e == nil && i < len(entries); i += 1 {
+			for j := i + 1; e == nil && j < len(entries); j += 1 {
+				distance := hashDistance(entries[i].hash, entries[j].hash)
+				if distance <= DUPLICATE_COVER_DISTANCE {
+					var first, second *Comic
+					first, e = txLookupIndexed(tx, comics, entries, i)
+					if e == nil {
+						second, e = txLookupIndexed(tx, comics, entries, j)
+					}
+					if e == nil && first != nil && second != nil {
+						dups = append(dups, DuplicateCovers{first, second, distance})
+					}
+				}
+			}
+		}
+		return e
+	})
+	return
+}
+
+/*
+txLookupIndexed gets the comic for the hash entry at index i, caching results in comics
+*/
+func txLookupIndexed(tx *bolt.Tx, comics map[int]*Comic, entries []hashEntry,
+	i int) (comic *Comic, err error) {
+
+	comic, found := comics[i]
+	if !found {
+		query := boltq.NewQuery([]byte(COMIC_COL), boltq.EqAll(entries[i].key)...)
+		var encoded [][]byte
+		encoded, err = boltq.TxQuery(tx, query)
+		if err == nil && len(encoded) > 0 {
+			comic = &Comic{}
+			err = json.Unmarshal(encoded[0], comic)
+		}
+		comics[i] = comic
+	}
+	return
+}
+
+/*
+ComicDuplicatesHandler handles requests to the duplicate covers report
+*/
+type ComicDuplicatesHandler struct {
+	loginTemplate   *template.Template
+	blockedTemplate *template.Template
+	dupTemplate     *template.Template
+	ds              boltq.DataStore
+	webroot         string
+	imgPrefix       string
+	covers          CoverLinks
+}
+
+/*
+ComicsDuplicates creates a new ComicDuplicatesHandler
+*/
+func ComicsDuplicates(db *bolt.DB, webroot string, local bool) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	dup := CreateTemplate(webroot, "base.html", "comicduplicates.template")
+	ds := boltq.DataStore{db}
+	imgPrefix := getImgPrefix(ds, local)
+	covers := newCoverLinks(ds, imgPrefix, local)
+	return &Wrapper{ComicDuplicatesHandler{login, block, dup, ds, webroot, imgPrefix, covers}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicDuplicatesHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	var err *AppError
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "Admin", "")
+	if authorized && templateErr == nil {
+		dups, queryErr := findDuplicateCovers(h.ds)
+		if queryErr != nil {
+			data["Status"] = fmt.Sprintf("Problem finding duplicate covers: %v", queryErr)
+		}
+		data["Duplicates"] = dups
+		data["ImgPrefix"] = h.imgPrefix
+		data["Covers"] = h.covers
+		templateErr = h.dupTemplate.Execute(w, data)
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return err
+}
@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/* number of comics in the recently added section of the comics page */
+	RECENT_COUNT = 8
+	/* number of entries in the feeds */
+	FEED_COUNT = 25
+	FEED_TITLE = "clementscode: recently added comics"
+	/* index of comic keys by the time they were added */
+	COMIC_ADDED_COL = "comics_added"
+)
+
+func (comic *Comic) FormatAdded() string {
+	return formatDay(comic.Added)
+}
+
+/*
+addedKey orders the added index by the time the comic was added, the comic key keeps entries unique
+*/
+func addedKey(added time.Time, key [][]byte) []byte {
+	indexKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(indexKey, uint64(added.UnixNano()))
+	return append(indexKey, boltq.SerializeComposite(key)...)
+}
+
+/*
+TxUpdateAddedIndex moves the comic's entry in the added index from the time prev was added.
+Nothing is kept until getRecentComics builds the index.
+*/
+func TxUpdateAddedIndex(tx *bolt.Tx, key [][]byte, comic, prev *Comic) (err error) {
+	b := tx.Bucket([]byte(COMIC_ADDED_COL))
+	if b == nil {
+		return
+	}
+	if !prev.Added.IsZero() {
+		err = b.Delete(addedKey(prev.Added, key))
+	}
+	if err == nil && !comic.Added.IsZero() {
+		err = b.Put(addedKey(comic.Added, key), boltq.SerializeComposite(key))
+	}
+	return
+}
+
+/*
+TxDeleteAdded removes the comic with the given key from the added index
+*/
+func TxDeleteAdded(tx *bolt.Tx, key [][]byte, added time.Time) (err error) {
+	b := tx.Bucket([]byte(COMIC_ADDED_COL))
+	if b != nil && !added.IsZero() {
+		err = b.Delete(addedKey(added, key))
+	}
+	return
+}
+
+/*
+buildAddedIndex creates the added index from every comic in the db
+*/
+func buildAddedIndex(ds boltq.DataStore) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(COMIC_ADDED_COL)) != nil {
+			/* another request got here first */
+			return nil
+		}
+		b, e := tx.CreateBucket([]byte(COMIC_ADDED_COL))
+		var results [][]byte
+		if e == nil {
+			results, e = boltq.TxQuery(tx, boltq.NewQuery([]byte(COMIC_COL), boltq.Any()))
+		}
+		for i := 0; e == nil && i < len(results); i += 1 {
+			var comic Comic
+			e = json.Unmarshal(results[i], &comic)
+			if e == nil && !comic.Added.IsZero() {
+				key := comic.CreateKey()
+				e = b.Put(addedKey(comic.Added, key), boltq.SerializeComposite(key))
+			}
+		}
+		return e
+	})
+}
+
+/*
+getRecentComics gets up to count of the most recently added comics, newest first.
+Comics added before timestamps were recorded are never included.
+*/
+func getRecentComics(ds boltq.DataStore, count int) (recent []*Comic, err error) {
+	var built bool
+	err = ds.View(func(tx *bolt.Tx) error {
+		built = tx.Bucket([]byte(COMIC_ADDED_COL)) != nil
+		return nil
+	})
+	if err == nil && !built {
+		err = buildAddedIndex(ds)
+	}
+	if err != nil {
+		return
+	}
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		c := tx.Bucket([]byte(COMIC_ADDED_COL)).Cursor()
+		for k, v := c.Last(); e == nil && k != nil && len(recent) < count; k, v = c.Prev() {
+			var key [][]byte
+			key, e = boltq.DeserializeComposite(v)
+			if e == nil {
+				var comic Comic
+				var found bool
+				comic, found, e = txGetComic(tx, key)
+				if found {
+					recent = append(recent, &comic)
+				}
+			}
+		}
+		return
+	})
+	return
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+/*
+siteURL returns the scheme and host the request was made to
+*/
+func siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+/*
+feedSummary is the HTML for a comic in the feeds, a cover thumbnail and the basic details
+*/
+var feedSummary = template.Must(template.New("summary").Parse(
+	`<p><a href="{{.Link}}"><img src="{{.Thumb}}" alt="cover"/></a></p>` +
+		`<p>{{.Comic.Publisher}} {{.Comic.Title}} #{{.Comic.FormatIssue}} ({{.Comic.CoverId}}), published {{.Comic.FormatDate}}</p>`))
+
+/*
+ComicFeedHandler handles requests for the recently added comics feeds
+*/
+type ComicFeedHandler struct {
+	ds     boltq.DataStore
+	covers CoverLinks
+}
+
+/*
+ComicsFeed creates a new ComicFeedHandler
+*/
+func ComicsFeed(db *bolt.DB, webroot string, local bool) *Wrapper {
+	ds := boltq.DataStore{db}
+	imgPrefix := getImgPrefix(ds, local)
+	return &Wrapper{ComicFeedHandler{ds, newCoverLinks(ds, imgPrefix, local)}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicFeedHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	recent, err := getRecentComics(h.ds, FEED_COUNT)
+	if err != nil {
+		err = fmt.Errorf("Unable to get recent comics: %v", err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	}
+
+	site := siteURL(r)
+	var feed interface{}
+	var contentType string
+	if r.FormValue("format") == "rss" {
+		feed = h.rss(recent, site)
+		contentType = "application/rss+xml"
+	} else {
+		feed = h.atom(recent, site)
+		contentType = "application/atom+xml"
+	}
+
+	encoded, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("Unable to encode feed: %v", err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(encoded)
+	return nil
+}
+
+/*
+summary renders the HTML description of the comic
+*/
+func (h ComicFeedHandler) summary(comic *Comic, link, site string) string {
+	thumb := h.covers.Thumb(comic)
+	if strings.HasPrefix(thumb, "/") {
+		/* feed readers need absolute urls */
+		thumb = site + thumb
+	}
+	var buff bytes.Buffer
+	err := feedSummary.Execute(&buff, map[string]interface{}{
+		"Comic": comic,
+		"Link":  link,
+		"Thumb": thumb,
+	})
+	if err != nil {
+		log.Printf("Problem rendering feed summary: %v", err)
+	}
+	return buff.String()
+}
+
+func entryTitle(comic *Comic) string {
+	return fmt.Sprintf("%v #%v (%v)", comic.Title, comic.FormatIssue(), comic.CoverId)
+}
+
+func (h ComicFeedHandler) atom(recent []*Comic, site string) atomFeed {
+	feed := atomFeed{
+		Title: FEED_TITLE,
+		Id:    site + "/comics/feed",
+		Links: []atomLink{
+			{"self", "application/atom+xml", site + "/comics/feed"},
+			{"alternate", "text/html", site + "/comics/"},
+		},
+	}
+	/* the feed changes whenever any of its entries do, an empty feed still needs an updated time */
+	var updated time.Time
+	for _, comic := range recent {
+		if comic.Updated.After(updated) {
+			updated = comic.Updated
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	for _, comic := range recent {
+		link := site + "/comics/" + comic.FullPath()
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     entryTitle(comic),
+			Id:        link,
+			Link:      atomLink{"alternate", "text/html", link},
+			Published: comic.Added.Format(time.RFC3339),
+			Updated:   comic.Updated.Format(time.RFC3339),
+			Content:   atomContent{"html", h.summary(comic, link, site)},
+		})
+	}
+	return feed
+}
+
+func (h ComicFeedHandler) rss(recent []*Comic, site string) rssFeed {
+	channel := rssChannel{FEED_TITLE, site + "/comics/", "Comics recently added to the collection", nil}
+	for _, comic := range recent {
+		link := site + "/comics/" + comic.FullPath()
+		channel.Items = append(channel.Items, rssItem{entryTitle(comic), link, link,
+			comic.Added.Format(time.RFC1123Z), h.summary(comic, link, site)})
+	}
+	return rssFeed{Version: "2.0", Channel: channel}
+}
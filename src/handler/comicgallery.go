@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bclement/boltq"
+)
+
+const (
+	GALLERY_DIR       = "gallery"
+	GALLERY_THUMB_DIR = "gallerythumbs"
+)
+
+/*
+GalleryImage is an extra scan of a comic or book, such as a back cover or interior page
+*/
+type GalleryImage struct {
+	Path      string
+	ThumbPath string
+	Caption   string
+}
+
+/*
+GalleryView holds what the comic view template needs to display one gallery
+*/
+type GalleryView struct {
+	Images    []GalleryImage
+	ImgPrefix string
+	CoverId   string
+	/* id of the book that owns the gallery, empty for the comic gallery */
+	Book     string
+	Uploader bool
+}
+
+/*
+addGalleryViews sets the comic and book gallery views in the page data
+*/
+func addGalleryViews(pagedata PageData, comic *Comic, imgPrefix string) {
+	uploader, _ := pagedata["Uploader"].(bool)
+	pagedata["Gallery"] = GalleryView{comic.Gallery, imgPrefix, comic.CoverId, "", uploader}
+	books := make([]GalleryView, len(comic.Books))
+	for i := range comic.Books {
+		books[i] = GalleryView{comic.Books[i].Gallery, imgPrefix, comic.CoverId,
+			strconv.Itoa(comic.Books[i].Id), uploader}
+	}
+	pagedata["BookGalleries"] = books
+}
+
+/*
+galleryPaths returns the stored file paths for the images in the gallery
+*/
+func galleryPaths(gallery []GalleryImage) []string {
+	var paths []string
+	for _, img := range gallery {
+		paths = append(paths, img.Path, img.ThumbPath)
+	}
+	return paths
+}
+
+/*
+thumbSpec returns the rendition spec used for gallery thumbnails
+*/
+func thumbSpec(specs []RenditionSpec) RenditionSpec {
+	for _, spec := range specs {
+		if spec.Name == THUMB_RENDITION {
+			return spec
+		}
+	}
+	return defaultRenditions[0]
+}
+
+/*
+processGallery handles the gallery actions from the comic view page
+*/
+func processGallery(ds boltq.DataStore, storer FileStorer, r *http.Request, action string) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	comic, found, err := getComic(ds, key)
+	if err != nil {
+		return fmt.Sprintf("Can't lookup comic: %v", err.Error())
+	} else if !found {
+		return fmt.Sprintf("Unable to find comic: %v", formatKeys(key))
+	}
+
+	gallery, status := selectGallery(&comic, r.FormValue("book"))
+	var removed []string
+	if status == "" {
+		if action == "add image" {
+			var signed *Book
+			if r.FormValue("signaturePhoto") == "true" {
+				signed, status = signedBook(&comic, r.FormValue("book"))
+			}
+			if status == "" {
+				status = addGalleryImage(ds, storer, r, &comic, gallery)
+			}
+			if status == "" && signed != nil {
+				signed.Signature.Photo = (*gallery)[len(*gallery)-1].Path
+			}
+		} else {
+			var index int
+			index, err = strconv.Atoi(r.FormValue("image"))
+			if err != nil || index < 0 || index >= len(*gallery) {
+				status = "Unknown image"
+			} else if action == "delete image" {
+				clearSignaturePhoto(&comic, (*gallery)[index].Path)
+				removed = removeGalleryImage(gallery, index)
+			} else if action == "move image up" {
+				moveGalleryImage(*gallery, index, -1)
+			} else if action == "move image down" {
+				moveGalleryImage(*gallery, index, 1)
+			}
+		}
+	}
+	if status == "" {
+		err = storeComic(ds, key, &comic, editorOf(r))
+		if err != nil {
+			status = fmt.Sprintf("Unable to save comic: %v", err.Error())
+		}
+	}
+	if status == "" {
+		/* files are only deleted once the comic no longer points at them */
+		deleteStoredFiles(storer, removed, &comic)
+	}
+	return status
+}
+
+/*
+selectGallery returns the comic gallery if bookStr is empty,
+otherwise the gallery of the book with that id
+*/
+func selectGallery(comic *Comic, bookStr string) (gallery *[]GalleryImage, status string) {
+	if bookStr == "" {
+		gallery = &comic.Gallery
+	} else {
+		index, found := comic.FindBook(bookStr)
+		if !found {
+			status = "Unknown book"
+		} else {
+			gallery = &comic.Books[index].Gallery
+		}
+	}
+	return
+}
+
+/*
+signedBook finds the signed book that a signature photo is being added for
+*/
+func signedBook(comic *Comic, bookStr string) (book *Book, status string) {
+	index, found := comic.FindBook(bookStr)
+	if !found {
+		status = "Signature photos belong to a book"
+	} else if !comic.Books[index].Signed {
+		status = "Book isn't signed"
+	} else {
+		book = &comic.Books[index]
+	}
+	return
+}
+
+/*
+clearSignaturePhoto forgets any signature photo stored at path, it's used before the image is deleted
+*/
+func clearSignaturePhoto(comic *Comic, path string) {
+	for i := range comic.Books {
+		if comic.Books[i].Signature.Photo == path {
+			comic.Books[i].Signature.Photo = ""
+		}
+	}
+}
+
+/*
+addGalleryImage stores the uploaded image and a thumbnail and appends it to the gallery
+*/
+func addGalleryImage(ds boltq.DataStore, storer FileStorer, r *http.Request,
+	comic *Comic, gallery *[]GalleryImage) (status string) {
+
+	formFile, _, err := r.FormFile("galleryImage")
+	if err != nil {
+		if err == http.ErrMissingFile {
+			status = "Missing image file"
+		} else {
+			status = fmt.Sprintf("Unable to save image: %v", err.Error())
+		}
+		return
+	}
+	defer formFile.Close()
+	data, contentType, ext, status := readCoverFile(formFile, getCoverLimits(ds))
+	if status != "" {
+		return
+	}
+	img, err := decodeCover(data)
+	if err != nil {
+		status = "Unable to read image, the file may be damaged"
+		return
+	}
+
+	/* timestamp keeps names unique as images are added and removed */
+	dirName := comic.SeriesKey()
+	baseName := fmt.Sprintf("%v_%v_%d", comic.IssueKey(), comic.CoverKey(), time.Now().UnixNano())
+	fullDir := filepath.Join(GALLERY_DIR, dirName)
+	err = storer.Store(contentType, fullDir, baseName+ext, bytes.NewReader(data), int64(len(data)))
+
+	spec := thumbSpec(GetRenditions(ds))
+	thumbDir := filepath.Join(GALLERY_THUMB_DIR, dirName)
+	var buff bytes.Buffer
+	if err == nil {
+		_, err = makeRendition(img, spec, &buff)
+	}
+	if err == nil {
+		thumb := bytes.NewReader(buff.Bytes())
+		err = storer.Store(spec.ContentType(), thumbDir, baseName+spec.Ext(), thumb, int64(buff.Len()))
+	}
+	if err == nil {
+		*gallery = append(*gallery, GalleryImage{filepath.Join(fullDir, baseName+ext),
+			filepath.Join(thumbDir, baseName+spec.Ext()), r.FormValue("caption")})
+	} else {
+		status = fmt.Sprintf("Unable to save image: %v", err.Error())
+	}
+	return
+}
+
+/*
+removeGalleryImage removes the image at index from the gallery and returns the paths of its files
+*/
+func removeGalleryImage(gallery *[]GalleryImage, index int) []string {
+	removed := (*gallery)[index]
+	*gallery = append((*gallery)[:index], (*gallery)[index+1:]...)
+	return []string{removed.Path, removed.ThumbPath}
+}
+
+/*
+moveGalleryImage swaps the image at index with its neighbor in the direction of delta
+*/
+func moveGalleryImage(gallery []GalleryImage, index, delta int) {
+	other := index + delta
+	if other >= 0 && other < len(gallery) {
+		gallery[index], gallery[other] = gallery[other], gallery[index]
+	}
+}
@@ -0,0 +1,316 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	HISTORY_COL = "comics.history"
+	/* editor recorded for changes made by background jobs and command line tools */
+	SYSTEM_EDITOR = "system"
+	/* longest value shown for a field in the history panel */
+	HISTORY_VALUE_LIMIT = 200
+	/* summary of the version recorded for comics stored before history was kept */
+	BASELINE_SUMMARY = "before history was recorded"
+)
+
+/*
+FieldChange is the before and after value of a comic field
+*/
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+/*
+ComicVersion records a write to a comic along with a copy of the comic after the write
+*/
+type ComicVersion struct {
+	Version int
+	Editor  string
+	Time    time.Time
+	/* optional description of the write, like a revert */
+	Summary string
+	Changes []FieldChange
+	Comic   Comic
+}
+
+func (cv *ComicVersion) FormatTime() string {
+	return cv.Time.Format("2006-01-02 15:04")
+}
+
+/*
+editorOf returns the email of the logged in user making the request, changes are attributed to it
+*/
+func editorOf(r *http.Request) string {
+	return getLoginInfo(r).Email
+}
+
+/*
+diffComics compares the comics field by field. The updated time is ignored since it changes with every write
+and the book sequence is ignored since new books already show up as changes.
+*/
+func diffComics(prev, curr *Comic) (changes []FieldChange) {
+	pv, cv := reflect.ValueOf(prev).Elem(), reflect.ValueOf(curr).Elem()
+	t := pv.Type()
+	for i := 0; i < t.NumField(); i += 1 {
+		name := t.Field(i).Name
+		if name == "Updated" || name == "BookSeq" {
+			continue
+		}
+		before, after := describeField(pv.Field(i)), describeField(cv.Field(i))
+		if before != after {
+			changes = append(changes, FieldChange{name, truncate(before), truncate(after)})
+		}
+	}
+	return
+}
+
+/*
+describeField formats a comic field for the history, complex fields are shown as JSON
+*/
+func describeField(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return ""
+		}
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	encoded, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	return string(encoded)
+}
+
+func truncate(s string) string {
+	if len(s) > HISTORY_VALUE_LIMIT {
+		return s[:HISTORY_VALUE_LIMIT] + "..."
+	}
+	return s
+}
+
+/*
+txHistoryBucket gets the history bucket for the comic, creating it if needed
+*/
+func txHistoryBucket(tx *bolt.Tx, key [][]byte) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(HISTORY_COL))
+	if err == nil {
+		b, err = b.CreateBucketIfNotExists(boltq.SerializeComposite(key))
+	}
+	return b, err
+}
+
+/*
+txAppendHistory records the write to the comic as the next version.
+Writes that don't change anything aren't recorded. The first recorded write to a comic stored
+before history was kept also records the comic as it was, as version 0, so the write can be reverted.
+*/
+func txAppendHistory(tx *bolt.Tx, key [][]byte, prev, curr *Comic, editor, summary string) error {
+	changes := diffComics(prev, curr)
+	if len(changes) == 0 && summary == "" {
+		return nil
+	}
+	b, err := txHistoryBucket(tx, key)
+	if err == nil && b.Sequence() == 0 && prev.SeriesId != "" {
+		when := prev.Updated
+		if when.IsZero() {
+			when = prev.Added
+		}
+		err = txPutVersion(b, ComicVersion{0, SYSTEM_EDITOR, when, BASELINE_SUMMARY, nil, *prev})
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = b.NextSequence()
+	}
+	if err == nil {
+		err = txPutVersion(b, ComicVersion{int(seq), editor, time.Now(), summary, changes, *curr})
+	}
+	return err
+}
+
+/*
+txPutVersion stores the version in the comic's history bucket
+*/
+func txPutVersion(b *bolt.Bucket, version ComicVersion) error {
+	encoded, err := json.Marshal(&version)
+	if err == nil {
+		err = b.Put(versionKey(version.Version), encoded)
+	}
+	return err
+}
+
+/*
+versionKey encodes the version so the history bucket sorts in version order
+*/
+func versionKey(version int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(version))
+	return k
+}
+
+/*
+getComicHistory gets every recorded version of the comic, newest first
+*/
+func getComicHistory(ds boltq.DataStore, key [][]byte) (versions []ComicVersion, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(HISTORY_COL))
+		if b != nil {
+			b = b.Bucket(boltq.SerializeComposite(key))
+		}
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var e error
+		for k, v := c.Last(); e == nil && k != nil; k, v = c.Prev() {
+			var version ComicVersion
+			e = json.Unmarshal(v, &version)
+			if e == nil {
+				versions = append(versions, version)
+			}
+		}
+		return e
+	})
+	return
+}
+
+/*
+getComicVersion gets a single version of the comic, found is false if there is no such version
+*/
+func getComicVersion(ds boltq.DataStore, key [][]byte, version int) (cv ComicVersion, found bool, err error) {
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(HISTORY_COL))
+		if b != nil {
+			b = b.Bucket(boltq.SerializeComposite(key))
+		}
+		if b != nil {
+			encoded := b.Get(versionKey(version))
+			if encoded != nil {
+				found = true
+				e = json.Unmarshal(encoded, &cv)
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+updateComicIndexes updates the missing, totals, cover hash and barcode indexes after a comic is stored.
+Problems are logged since the comic itself was saved.
+*/
+func updateComicIndexes(ds boltq.DataStore, comic Comic) {
+	missingErr := UpdateMissingIndex(ds, comic)
+	if missingErr != nil {
+		log.Printf("Problem updating missing index %v", missingErr)
+	}
+	totalsErr := UpdateComicTotals(ds, comic.SeriesId)
+	if totalsErr != nil {
+		log.Printf("Problem updating comic totals %v", totalsErr)
+	}
+	hashErr := UpdateCoverHashIndex(ds, comic)
+	if hashErr != nil {
+		log.Printf("Problem updating cover hash index %v", hashErr)
+	}
+	upcErr := UpdateUPCIndex(ds, comic)
+	if upcErr != nil {
+		log.Printf("Problem updating barcode index %v", upcErr)
+	}
+}
+
+/*
+keepCurrentState copies what a revert shouldn't change from the current comic. Loans, locations,
+gallery images and digital copies change outside of catalogue edits and old versions can point at
+files that were deleted since.
+*/
+func keepCurrentState(comic, current *Comic) {
+	comic.Gallery = current.Gallery
+	comic.DigitalPath = current.DigitalPath
+	books := make([]Book, len(comic.Books))
+	copy(books, comic.Books)
+	for i := range books {
+		book := &books[i]
+		index := current.BookIndex(book.Id)
+		if index >= 0 {
+			now := current.Books[index]
+			book.Loans, book.Box, book.Slot = now.Loans, now.Box, now.Slot
+			book.Gallery, book.Signature.Photo = now.Gallery, now.Signature.Photo
+		} else {
+			/* the book was removed, its images went with it */
+			book.Gallery, book.Signature.Photo = nil, ""
+		}
+	}
+	comic.Books = books
+}
+
+/*
+processRevert restores the comic to the version selected on the view page
+*/
+func processRevert(ds boltq.DataStore, r *http.Request) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		return "Unknown version"
+	}
+	cv, found, err := getComicVersion(ds, key, version)
+	if err != nil {
+		return fmt.Sprintf("Can't lookup version: %v", err.Error())
+	} else if !found {
+		return fmt.Sprintf("Unable to find version %d", version)
+	}
+	current, found, err := getComic(ds, key)
+	if err != nil {
+		return fmt.Sprintf("Can't lookup comic: %v", err.Error())
+	}
+	comic := cv.Comic
+	if found {
+		keepCurrentState(&comic, &current)
+		/* reverting doesn't make an old comic look recently added */
+		comic.Added = current.Added
+		if current.BookSeq > comic.BookSeq {
+			/* ids of books added since the version aren't handed out again */
+			comic.BookSeq = current.BookSeq
+		}
+		if !bytes.Equal(boltq.SerializeComposite(comic.CreateKey()), boltq.SerializeComposite(key)) {
+			/* versions from before a rename keep the current name and cover files */
+			comic.SeriesId, comic.Issue, comic.CoverId = current.SeriesId, current.Issue, current.CoverId
+			comic.CoverPath, comic.Renditions, comic.SpecsKey = current.CoverPath, current.Renditions, current.SpecsKey
+			comic.CoverHash = current.CoverHash
+		}
+	}
+	summary := fmt.Sprintf("reverted to version %d", version)
+	err = storeComicVersion(ds, key, &comic, editorOf(r), summary)
+	if err != nil {
+		return fmt.Sprintf("Unable to save comic: %v", err.Error())
+	}
+	updateComicIndexes(ds, comic)
+	return summary
+}
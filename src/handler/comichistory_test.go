@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+func TestRevertKeepsLoansAndLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comichistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ds := boltq.DataStore{db}
+
+	comic := Comic{SeriesId: "Star Wars", Issue: "1", CoverId: "a", Title: "Star Wars",
+		Notes: "original", Books: []Book{{Grade: "VF"}}}
+	key := comic.CreateKey()
+	store := func(change func(c *Comic)) {
+		current, _, err := getComic(ds, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.SeriesId == "" {
+			current = comic
+		}
+		change(&current)
+		if err = storeComic(ds, key, &current, "tester"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := time.Now().Add(-48 * time.Hour)
+	store(func(c *Comic) {})
+	store(func(c *Comic) {
+		c.Books[0].Loans = []Loan{{Borrower: "Bob", Out: out}}
+		c.Books[0].Box = "box 1"
+	})
+	store(func(c *Comic) { c.Notes = "bad edit" })
+	store(func(c *Comic) {
+		c.Books[0].Loans[0].Returned = time.Now()
+		c.Books[0].Box, c.Books[0].Slot = "box 2", 4
+		c.Gallery = []GalleryImage{{Path: "gallery/star_wars/new.jpg"}}
+	})
+
+	history, err := getComicHistory(ds, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := -1
+	for _, cv := range history {
+		if cv.Comic.Notes == "original" && len(cv.Comic.Books[0].Loans) == 1 {
+			version = cv.Version
+		}
+	}
+	if version < 0 {
+		t.Fatalf("no version before the bad edit in %+v", history)
+	}
+
+	form := url.Values{"version": {strconv.Itoa(version)}}
+	r := httptest.NewRequest("POST", "/comics/star_wars/1/a", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = mux.SetURLVars(r, map[string]string{"series": "star_wars", "issue": "1", "cover": "a"})
+	status := processRevert(ds, r)
+	if !strings.HasPrefix(status, "reverted") {
+		t.Fatal(status)
+	}
+
+	reverted, _, err := getComic(ds, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Notes != "original" {
+		t.Errorf("expected the notes to be reverted, got %q", reverted.Notes)
+	}
+	book := reverted.Books[0]
+	if len(book.Loans) != 1 || book.Loans[0].Returned.IsZero() || book.CurrentLoan() != nil {
+		t.Errorf("expected the loan to stay returned, got %+v", book.Loans)
+	}
+	if book.Box != "box 2" || book.Slot != 4 {
+		t.Errorf("expected the book to stay in box 2 slot 4, got %v %d", book.Box, book.Slot)
+	}
+	if len(reverted.Gallery) != 1 {
+		t.Errorf("expected the gallery to be kept, got %+v", reverted.Gallery)
+	}
+}
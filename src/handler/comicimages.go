@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/nfnt/resize"
+)
+
+const (
+	/* resized widths are rounded up to a multiple of this to limit cache entries */
+	IMAGE_WIDTH_STEP = 50
+	IMAGE_MAX_WIDTH  = 2000
+	IMAGE_MAX_AGE    = 7 * 24 * time.Hour
+)
+
+/*
+CoverLinks builds the urls for cover images in templates. Local covers go through the image
+endpoint so they get cache headers and resizing, remote covers are linked to directly.
+*/
+type CoverLinks struct {
+	ImgPrefix string
+	Endpoint  bool
+	/* width requested for thumbnails from the endpoint */
+	ThumbWidth uint
+}
+
+/*
+newCoverLinks creates the cover links for the image prefix, local covers use the image endpoint
+*/
+func newCoverLinks(ds boltq.DataStore, imgPrefix string, local bool) CoverLinks {
+	return CoverLinks{imgPrefix, local, thumbSpec(GetRenditions(ds)).MaxWidth}
+}
+
+/*
+imageURL is the image endpoint url for the comic's cover with the query.
+The cover version is included so a replaced cover isn't served from a stale cache.
+*/
+func imageURL(comic *Comic, query string) string {
+	rval := "/comics/images/" + comic.FullPath() + "?v=" + coverVersion(comic)
+	if query != "" {
+		rval += "&" + query
+	}
+	return rval
+}
+
+/*
+coverVersion identifies the stored cover, it changes whenever the cover or its renditions are replaced
+*/
+func coverVersion(comic *Comic) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v|%v|%v", comic.CoverPath, comic.CoverHash, comic.SpecsKey)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+/*
+Cover returns the url of the display sized cover
+*/
+func (cl CoverLinks) Cover(comic *Comic) string {
+	if !cl.Endpoint {
+		return cl.ImgPrefix + "/" + comic.CoverSrc()
+	}
+	var query string
+	if comic.RenditionPath(COVER_RENDITION) != "" {
+		query = "r=" + COVER_RENDITION
+	}
+	return imageURL(comic, query)
+}
+
+/*
+Thumb returns the url of the cover thumbnail
+*/
+func (cl CoverLinks) Thumb(comic *Comic) string {
+	if !cl.Endpoint {
+		return cl.ImgPrefix + "/" + comic.ThumbPath()
+	}
+	return imageURL(comic, fmt.Sprintf("w=%d", cl.ThumbWidth))
+}
+
+/*
+Srcset returns the srcset attribute value listing the cover renditions
+*/
+func (cl CoverLinks) Srcset(comic *Comic) string {
+	if !cl.Endpoint {
+		return comic.Srcset(cl.ImgPrefix)
+	}
+	parts := make([]string, 0, len(comic.Renditions))
+	seen := make(map[int]bool)
+	for _, r := range comic.Renditions {
+		if r.Width > 0 && !seen[r.Width] {
+			seen[r.Width] = true
+			parts = append(parts, fmt.Sprintf("%v %dw", imageURL(comic, "r="+url.QueryEscape(r.Name)), r.Width))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+ComicImageHandler serves cover images for a comic key through the file storer
+*/
+type ComicImageHandler struct {
+	ds       boltq.DataStore
+	storer   FileStorer
+	cacheDir string
+}
+
+/*
+ComicImages creates a new ComicImageHandler, resized images are cached under cacheDir
+which defaults to cache/covers in the webroot
+*/
+func ComicImages(db *bolt.DB, webroot, cacheDir string, local bool) *Wrapper {
+	ds := boltq.DataStore{db}
+	storer := NewFileStorer(ds, webroot, local)
+	if cacheDir == "" {
+		cacheDir = filepath.Join(webroot, "cache", "covers")
+	}
+	return &Wrapper{ComicImageHandler{ds, storer, cacheDir}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicImageHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return &AppError{nil, status, http.StatusBadRequest}
+	}
+	comic, found, err := getComic(h.ds, key)
+	if err != nil {
+		err = fmt.Errorf("Can't lookup comic: %v", err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	} else if !found || comic.CoverPath == "" {
+		return &AppError{nil, "Cover not found", http.StatusNotFound}
+	}
+
+	width := 0
+	widthStr := r.FormValue("w")
+	if widthStr != "" {
+		width, err = strconv.Atoi(widthStr)
+		if err != nil || width <= 0 {
+			return &AppError{nil, "Width must be a positive integer", http.StatusBadRequest}
+		}
+		width = roundWidth(width)
+	}
+
+	path := filepath.Join("covers", comic.CoverPath)
+	rendition := r.FormValue("r")
+	if rendition != "" {
+		path = comic.RenditionPath(rendition)
+		if path == "" {
+			return &AppError{nil, "Unknown rendition " + rendition, http.StatusNotFound}
+		}
+	}
+
+	return h.serveImage(w, r, path, width)
+}
+
+/*
+roundWidth rounds the requested width up to the next step, within the max width
+*/
+func roundWidth(width int) int {
+	steps := (width + IMAGE_WIDTH_STEP - 1) / IMAGE_WIDTH_STEP
+	width = steps * IMAGE_WIDTH_STEP
+	if width > IMAGE_MAX_WIDTH {
+		width = IMAGE_MAX_WIDTH
+	}
+	return width
+}
+
+/*
+serveImage writes the stored image at path to the response, resizing it if width is set
+*/
+func (h ComicImageHandler) serveImage(w http.ResponseWriter, r *http.Request,
+	path string, width int) *AppError {
+
+	dirName, fileName := filepath.Split(path)
+	file, info, err := h.storer.Load(dirName, fileName)
+	if err != nil {
+		log.Printf("Problem loading image %v: %v", path, err)
+		return &AppError{nil, "Cover not found", http.StatusNotFound}
+	}
+	defer file.Close()
+
+	var content io.ReadSeeker
+	contentType := info.ContentType
+	if width > 0 {
+		var cached *os.File
+		cached, err = h.cachedResize(path, width, file, info)
+		if err == nil {
+			defer cached.Close()
+			content = cached
+			contentType = "image/jpeg"
+		}
+	} else if seeker, ok := file.(io.ReadSeeker); ok {
+		content = seeker
+	} else {
+		/* remote stores don't support seeking, buffer it for range requests */
+		var data []byte
+		data, err = ioutil.ReadAll(file)
+		content = bytes.NewReader(data)
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to serve image %v: %v", path, err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	}
+
+	headers := w.Header()
+	headers.Set("ETag", imageETag(path, width, info))
+	headers.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(IMAGE_MAX_AGE.Seconds())))
+	if contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+	/* handles Last-Modified, If-None-Match, If-Modified-Since and ranges */
+	http.ServeContent(w, r, fileName, info.ModTime, content)
+	return nil
+}
+
+/*
+imageETag creates a strong validator from the source file metadata and requested size
+*/
+func imageETag(path string, width int, info StoredFileInfo) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v|%d|%d|%d", path, width, info.Size, info.ModTime.UnixNano())
+	return fmt.Sprintf("\"%016x\"", h.Sum64())
+}
+
+/*
+cachedResize returns the resized image from the disk cache,
+creating it if the cache entry is missing or older than the source
+*/
+func (h ComicImageHandler) cachedResize(path string, width int, src io.Reader,
+	info StoredFileInfo) (*os.File, error) {
+
+	ext := filepath.Ext(path)
+	base := path[:len(path)-len(ext)]
+	cachePath := filepath.Join(h.cacheDir, fmt.Sprintf("%v_w%d.jpg", base, width))
+	stat, err := os.Stat(cachePath)
+	if err == nil && !stat.ModTime().Before(info.ModTime) {
+		return os.Open(cachePath)
+	}
+
+	var img image.Image
+	img, err = decodeCoverReader(src)
+	if err == nil {
+		if uint(img.Bounds().Dx()) > uint(width) {
+			img = resize.Resize(uint(width), 0, img, resize.Lanczos3)
+		}
+		err = os.MkdirAll(filepath.Dir(cachePath), 0700)
+	}
+	if err == nil {
+		var buff bytes.Buffer
+		err = jpeg.Encode(&buff, img, nil)
+		if err == nil {
+			/* write to a temp file first so concurrent requests never see a partial image */
+			tmpPath := fmt.Sprintf("%v.%d.tmp", cachePath, time.Now().UnixNano())
+			err = overwriteFile(tmpPath, &buff)
+			if err == nil {
+				err = os.Rename(tmpPath, cachePath)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(cachePath)
+}
+
+/*
+decodeCoverReader reads all of src and decodes it as an upright cover image
+*/
+func decodeCoverReader(src io.Reader) (img image.Image, err error) {
+	var data []byte
+	data, err = ioutil.ReadAll(src)
+	if err == nil {
+		img, err = decodeCover(data)
+	}
+	return
+}
@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/* size of the cover thumbnails in the PDF report in points */
+	INVENTORY_THUMB_WIDTH  = 30
+	INVENTORY_THUMB_HEIGHT = 45
+)
+
+/*
+InventoryItem is a physical copy listed in the inventory report
+*/
+type InventoryItem struct {
+	Comic *Comic
+	Book  *Book
+}
+
+/*
+InventorySeries is the inventory for a series with its book count and value
+*/
+type InventorySeries struct {
+	Total SeriesTotal
+	Items []InventoryItem
+}
+
+/*
+Inventory is a dated list of every book in the collection for insurance purposes
+*/
+type Inventory struct {
+	Date   time.Time
+	Series []InventorySeries
+	Count  int
+	Value  int
+}
+
+func (inv *Inventory) FormatDate() string {
+	return formatDay(inv.Date)
+}
+
+func (inv *Inventory) FormatValue() string {
+	return FormatCurrency(inv.Value)
+}
+
+/*
+getInventory lists every book in the collection grouped by series.
+Series totals are calculated from the books listed so the report is consistent
+even if the stored totals are being recalculated.
+*/
+func getInventory(ds boltq.DataStore) (inv Inventory, err error) {
+	inv.Date = time.Now()
+	comics, err := GetAllComics(ds)
+	sl := NewSeriesList()
+	for _, comic := range comics {
+		if len(comic.Books) > 0 {
+			sl.Add(comic)
+		}
+	}
+	sort.Strings(sl.Keys)
+	for _, seriesId := range sl.Keys {
+		list := sl.Map[seriesId]
+		sort.Sort(list)
+		series := InventorySeries{SeriesTotal{seriesId, 0, 0, true}, nil}
+		for _, comic := range list {
+			for i := range comic.Books {
+				book := &comic.Books[i]
+				series.Items = append(series.Items, InventoryItem{comic, book})
+				series.Total.Count += 1
+				series.Total.Value += book.Value
+			}
+		}
+		inv.Series = append(inv.Series, series)
+		inv.Count += series.Total.Count
+		inv.Value += series.Total.Value
+	}
+	return
+}
+
+/*
+loadThumbJPEG loads the cover thumbnail from the storer and encodes it as an RGB JPEG for the PDF
+*/
+func loadThumbJPEG(storer FileStorer, comic *Comic) (data []byte, width, height int, err error) {
+	dirName, fileName := filepath.Split(comic.ThumbPath())
+	file, _, err := storer.Load(dirName, fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	img, err := decodeCoverReader(file)
+	if err != nil {
+		return
+	}
+	/* the PDF declares every image as RGB so grayscale and paletted images are converted */
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	var buff bytes.Buffer
+	err = jpeg.Encode(&buff, rgba, nil)
+	return buff.Bytes(), bounds.Dx(), bounds.Dy(), err
+}
+
+/*
+writeInventoryPDF renders the inventory as a PDF document
+*/
+func writeInventoryPDF(w http.ResponseWriter, inv Inventory, storer FileStorer) *AppError {
+	doc := NewPDFDoc()
+	doc.AddPage()
+	left := float64(PDF_MARGIN)
+	right := float64(PDF_PAGE_WIDTH - PDF_MARGIN)
+	y := float64(PDF_PAGE_HEIGHT - PDF_MARGIN)
+	/* columns after the thumbnail */
+	titleX, gradeX, signedX, valueX := left+40, left+300, left+420, right-70
+
+	doc.Text(left, y-14, 16, true, "Comic Collection Inventory")
+	y -= 32
+	doc.Text(left, y, 10, false, fmt.Sprintf("Prepared %v, %d books, total value %v",
+		inv.FormatDate(), inv.Count, inv.FormatValue()))
+	y -= 24
+
+	/* comics with several books share the same thumbnail */
+	thumbs := make(map[string]int)
+
+	/* starts a new page when there isn't room for a row of the given height */
+	ensure := func(height float64) {
+		if y-height < PDF_MARGIN {
+			doc.AddPage()
+			y = float64(PDF_PAGE_HEIGHT - PDF_MARGIN)
+		}
+	}
+
+	for _, series := range inv.Series {
+		ensure(40)
+		doc.Text(left, y-12, 12, true, series.Total.SeriesId)
+		y -= 18
+		doc.Text(titleX, y-10, 8, true, "Comic")
+		doc.Text(gradeX, y-10, 8, true, "Grade")
+		doc.Text(signedX, y-10, 8, true, "Signed")
+		doc.Text(valueX, y-10, 8, true, "Value")
+		y -= 14
+		doc.Line(left, y, right, y)
+		for _, item := range series.Items {
+			ensure(INVENTORY_THUMB_HEIGHT + 4)
+			y -= INVENTORY_THUMB_HEIGHT + 4
+			if item.Comic.CoverPath != "" {
+				id, loaded := thumbs[item.Comic.FullPath()]
+				if !loaded {
+					data, width, height, err := loadThumbJPEG(storer, item.Comic)
+					if err == nil {
+						id = doc.AddJPEG(data, width, height)
+					} else {
+						id = -1
+						log.Printf("Problem loading thumbnail for %v: %v", item.Comic.FullPath(), err)
+					}
+					thumbs[item.Comic.FullPath()] = id
+				}
+				if id >= 0 {
+					doc.Image(id, left, y+2, INVENTORY_THUMB_WIDTH, INVENTORY_THUMB_HEIGHT)
+				}
+			}
+			textY := y + INVENTORY_THUMB_HEIGHT/2
+			doc.Text(titleX, textY, 9, false, fmt.Sprintf("%v #%v (%v)",
+				item.Comic.Title, item.Comic.FormatIssue(), item.Comic.CoverId))
+			doc.Text(gradeX, textY, 9, false, item.Book.FormatGrade())
+			if item.Book.Signed {
+				doc.Text(signedX, textY, 9, false, "Yes")
+			}
+			doc.Text(valueX, textY, 9, false, item.Book.FormatValue())
+		}
+		ensure(24)
+		doc.Line(left, y, right, y)
+		doc.Text(titleX, y-12, 9, true, fmt.Sprintf("%v total, %d books", series.Total.SeriesId, series.Total.Count))
+		doc.Text(valueX, y-12, 9, true, series.Total.FormatValue())
+		y -= 28
+	}
+
+	ensure(20)
+	doc.Text(titleX, y-12, 11, true, fmt.Sprintf("Collection total, %d books", inv.Count))
+	doc.Text(valueX, y-12, 11, true, inv.FormatValue())
+
+	headers := w.Header()
+	headers.Set("Content-Type", "application/pdf")
+	headers.Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"comic-inventory-%v.pdf\"", inv.FormatDate()))
+	_, err := doc.WriteTo(w)
+	if err != nil {
+		log.Printf("Problem sending inventory PDF: %v", err)
+	}
+	return nil
+}
+
+/*
+ComicInventoryHandler handles requests to the insurance inventory report
+*/
+type ComicInventoryHandler struct {
+	loginTemplate     *template.Template
+	blockedTemplate   *template.Template
+	inventoryTemplate *template.Template
+	ds                boltq.DataStore
+	storer            FileStorer
+	imgPrefix         string
+	covers            CoverLinks
+}
+
+/*
+ComicsInventory creates a new ComicInventoryHandler
+*/
+func ComicsInventory(db *bolt.DB, webroot string, local bool) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	/* the print view doesn't use the site layout */
+	inventory := CreateTemplate(webroot, "comicinventory.template")
+	ds := boltq.DataStore{db}
+	storer := NewFileStorer(ds, webroot, local)
+	imgPrefix := getImgPrefix(ds, local)
+	covers := newCoverLinks(ds, imgPrefix, local)
+	return &Wrapper{ComicInventoryHandler{login, block, inventory, ds, storer, imgPrefix, covers}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicInventoryHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	var err *AppError
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "ComicUploader", "")
+	if authorized && templateErr == nil {
+		inv, queryErr := getInventory(h.ds)
+		if queryErr != nil {
+			e := fmt.Errorf("Problem building inventory: %v", queryErr)
+			return &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+		}
+		if r.FormValue("format") == "pdf" {
+			err = writeInventoryPDF(w, inv, h.storer)
+		} else {
+			data["Inventory"] = &inv
+			data["ImgPrefix"] = h.imgPrefix
+			data["Covers"] = h.covers
+			templateErr = h.inventoryTemplate.Execute(w, data)
+		}
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return err
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	txtemplate "text/template"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	DAY_FORMAT = "2006-01-02"
+	/* minimum time between reminder emails for the same loan */
+	REMINDER_INTERVAL = 7 * 24 * time.Hour
+)
+
+/*
+Loan records a physical copy being borrowed
+*/
+type Loan struct {
+	Borrower string
+	/* optional, needed for reminder emails */
+	Email    string
+	Out      time.Time
+	Due      time.Time
+	Returned time.Time
+	Reminded time.Time
+}
+
+/*
+OnLoan returns true if the book hasn't been returned yet
+*/
+func (l *Loan) OnLoan() bool {
+	return l.Returned.IsZero()
+}
+
+/*
+Overdue returns true if the book is still out past the due date
+*/
+func (l *Loan) Overdue() bool {
+	return l.OnLoan() && !l.Due.IsZero() && time.Now().After(l.Due)
+}
+
+func (l *Loan) FormatOut() string {
+	return formatDay(l.Out)
+}
+
+func (l *Loan) FormatDue() string {
+	return formatDay(l.Due)
+}
+
+func (l *Loan) FormatReturned() string {
+	return formatDay(l.Returned)
+}
+
+func (l *Loan) FormatReminded() string {
+	return formatDay(l.Reminded)
+}
+
+func formatDay(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(DAY_FORMAT)
+}
+
+/*
+CurrentLoan returns the loan for the book if it is currently lent out, nil otherwise
+*/
+func (b *Book) CurrentLoan() *Loan {
+	if len(b.Loans) > 0 {
+		last := &b.Loans[len(b.Loans)-1]
+		if last.OnLoan() {
+			return last
+		}
+	}
+	return nil
+}
+
+/*
+processDay is a callback function to be used with processField which gets a YYYY-MM-DD date from the request
+*/
+func processDay(r *http.Request, field, currStatus string, data PageData) (day time.Time, status string) {
+	status = processField(r, field, currStatus, func(text string) (status string) {
+		var err error
+		day, err = time.ParseInLocation(DAY_FORMAT, text, time.Local)
+		if err != nil {
+			status = fmt.Sprintf("Invalid date %v, expected YYYY-MM-DD", text)
+		} else {
+			data[field] = text
+		}
+		return
+	})
+	return
+}
+
+/*
+processEmail gets an optional email address from the request, the address must be valid if provided
+*/
+func processEmail(r *http.Request, field, currStatus string, data PageData) (email, status string) {
+	text := r.FormValue(field)
+	if text != "" {
+		addr, err := mail.ParseAddress(text)
+		if err != nil {
+			status = fmt.Sprintf("Invalid email address %v", text)
+		} else {
+			email = addr.Address
+			data[field] = text
+		}
+	}
+	if currStatus != "" {
+		status = currStatus
+	}
+	return
+}
+
+/*
+processLoan lends out or returns the book selected in the request
+*/
+func processLoan(ds boltq.DataStore, r *http.Request, action string, data PageData) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	comic, found, err := getComic(ds, key)
+	if err != nil {
+		return fmt.Sprintf("Can't lookup comic: %v", err.Error())
+	} else if !found {
+		return fmt.Sprintf("Unable to find comic: %v", formatKeys(key))
+	}
+	index, found := comic.FindBook(r.FormValue("book"))
+	if !found {
+		return "Unknown book"
+	}
+	book := &comic.Books[index]
+	current := book.CurrentLoan()
+
+	if action == "lend book" {
+		if current != nil {
+			return fmt.Sprintf("Book is already on loan to %v", current.Borrower)
+		}
+		var loan Loan
+		loan.Borrower, status = processString(r, "borrower", status, data)
+		loan.Due, status = processDay(r, "due", status, data)
+		loan.Email, status = processEmail(r, "borrowerEmail", status, data)
+		loan.Out = time.Now()
+		if status != "" {
+			return status
+		}
+		book.Loans = append(book.Loans, loan)
+	} else {
+		if current == nil {
+			return "Book isn't on loan"
+		}
+		current.Returned = time.Now()
+	}
+
+	err = storeComic(ds, key, &comic, editorOf(r))
+	if err != nil {
+		status = fmt.Sprintf("Unable to save comic: %v", err.Error())
+	}
+	return status
+}
+
+/*
+LoanedBook is a book that is currently on loan along with its comic
+*/
+type LoanedBook struct {
+	Comic *Comic
+	Book  *Book
+	Loan  *Loan
+}
+
+/*
+getLoanedBooks finds every book in the collection that is currently on loan
+*/
+func getLoanedBooks(ds boltq.DataStore) (loaned []LoanedBook, err error) {
+	comics, err := GetAllComics(ds)
+	for _, comic := range comics {
+		for i := range comic.Books {
+			book := &comic.Books[i]
+			loan := book.CurrentLoan()
+			if loan != nil {
+				loaned = append(loaned, LoanedBook{comic, book, loan})
+			}
+		}
+	}
+	return
+}
+
+/*
+SendLoanReminders emails every borrower with an overdue book that hasn't been reminded recently.
+Returns the number of reminders sent.
+*/
+func SendLoanReminders(ds boltq.DataStore, reminder *txtemplate.Template) (sent int, err error) {
+	creds, found := GetMailCreds(ds.DB)
+	if !found {
+		return 0, fmt.Errorf("Mail credentials not configured")
+	}
+	loaned, err := getLoanedBooks(ds)
+	if err != nil {
+		return
+	}
+	auth := smtp.PlainAuth("", creds.From, creds.Password, creds.Host)
+	qualified := fmt.Sprintf("%v:%d", creds.Host, creds.Port)
+	for i := 0; err == nil && i < len(loaned); i += 1 {
+		lb := loaned[i]
+		if !lb.Loan.Overdue() || lb.Loan.Email == "" ||
+			time.Since(lb.Loan.Reminded) < REMINDER_INTERVAL {
+			continue
+		}
+		msgData := map[string]interface{}{
+			"From":  creds.From,
+			"To":    lb.Loan.Email,
+			"Comic": lb.Comic,
+			"Loan":  lb.Loan,
+		}
+		var msg bytes.Buffer
+		err = reminder.Execute(&msg, msgData)
+		if err == nil {
+			err = smtp.SendMail(qualified, auth, creds.From, []string{lb.Loan.Email}, msg.Bytes())
+		}
+		if err == nil {
+			sent += 1
+			err = markReminded(ds, lb.Comic.CreateKey(), lb.Book.Id, lb.Loan.Out, time.Now())
+		}
+	}
+	return
+}
+
+/*
+markReminded records when the borrower of the loan that went out at the provided time was last reminded.
+This isn't a change to the catalogue so the comic is stored without a new history version.
+*/
+func markReminded(ds boltq.DataStore, key [][]byte, bookId int, out, reminded time.Time) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		comic, found, err := txGetComic(tx, key)
+		if err != nil || !found {
+			return err
+		}
+		index := comic.BookIndex(bookId)
+		if index < 0 {
+			return nil
+		}
+		book := &comic.Books[index]
+		for i := range book.Loans {
+			if book.Loans[i].Out.Equal(out) {
+				book.Loans[i].Reminded = reminded
+			}
+		}
+		encoded, err := json.Marshal(&comic)
+		if err == nil {
+			err = boltq.TxStore(tx, []byte(COMIC_COL), key, encoded)
+		}
+		return err
+	})
+}
+
+/*
+ComicLoansHandler handles requests to the books on loan page
+*/
+type ComicLoansHandler struct {
+	loginTemplate    *template.Template
+	blockedTemplate  *template.Template
+	loansTemplate    *template.Template
+	reminderTemplate *txtemplate.Template
+	ds               boltq.DataStore
+}
+
+/*
+ComicsLoans creates a new ComicLoansHandler
+*/
+func ComicsLoans(db *bolt.DB, webroot string) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	loans := CreateTemplate(webroot, "base.html", "comicloans.template")
+	reminderTemplateFile := webroot + "templates/loanreminder.template"
+	reminder, err := txtemplate.ParseFiles(reminderTemplateFile)
+	if err != nil {
+		log.Fatalf("Unable to parse reminder file %v: %v\n", reminderTemplateFile, err)
+	}
+	ds := boltq.DataStore{db}
+	return &Wrapper{ComicLoansHandler{login, block, loans, reminder, ds}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicLoansHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	var err *AppError
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "ComicUploader", "")
+	if authorized && templateErr == nil {
+		if r.Method == "POST" && r.FormValue("action") == "send reminders" {
+			sent, sendErr := SendLoanReminders(h.ds, h.reminderTemplate)
+			if sendErr != nil {
+				data["Status"] = fmt.Sprintf("Sent %d reminders before failing: %v", sent, sendErr)
+			} else {
+				data["Status"] = fmt.Sprintf("Sent %d reminders", sent)
+			}
+		}
+		loaned, queryErr := getLoanedBooks(h.ds)
+		if queryErr != nil {
+			data["Status"] = fmt.Sprintf("Problem finding books on loan: %v", queryErr)
+		}
+		data["Loaned"] = loaned
+		templateErr = h.loansTemplate.Execute(w, data)
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return err
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+func TestProcessEmail(t *testing.T) {
+	for text, valid := range map[string]bool{
+		"":                      true,
+		"bob@example.com":       true,
+		"Bob <bob@example.com>": true,
+		"bob":                   false,
+		"bob@example.com\r\nBcc: eve@example.com": false,
+	} {
+		form := url.Values{"borrowerEmail": {text}}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, status := processEmail(r, "borrowerEmail", "", PageData{})
+		if (status == "") != valid {
+			t.Errorf("email %q: unexpected status %q", text, status)
+		}
+	}
+}
+
+func TestReminderKeepsHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comicloans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ds := boltq.DataStore{db}
+
+	out := time.Now().Add(-48 * time.Hour).Round(time.Second)
+	comic := Comic{SeriesId: "Star Wars", Issue: "1", CoverId: "a", Title: "Star Wars",
+		Books: []Book{{Grade: "VF", Loans: []Loan{{Borrower: "Bob", Email: "bob@example.com", Out: out}}}}}
+	key := comic.CreateKey()
+	if err = storeComic(ds, key, &comic, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := getComicHistory(ds, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reminded := time.Now().Round(time.Second)
+	if err = markReminded(ds, key, comic.Books[0].Id, out, reminded); err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := getComic(ds, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Books[0].Loans[0].Reminded.Equal(reminded) {
+		t.Errorf("expected the reminder time to be recorded, got %v", stored.Books[0].Loans[0].Reminded)
+	}
+	after, err := getComicHistory(ds, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected no new history version, had %d now %d", len(before), len(after))
+	}
+}
@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	BOX_COL = "comics.boxes"
+	/* pseudo box key used to list books that haven't been put away */
+	UNBOXED = "unboxed"
+)
+
+/*
+Box is a storage container for physical copies, boxes are kept in rooms
+*/
+type Box struct {
+	Name string
+	Room string
+}
+
+/*
+Key returns the key used to store the box and reference it from books
+*/
+func (b Box) Key() string {
+	return SanitizeKey(b.Name)
+}
+
+/*
+Path returns the url escaped box key
+*/
+func (b Box) Path() string {
+	return url.QueryEscape(b.Key())
+}
+
+/*
+getBoxes gets every box keyed by box key
+*/
+func getBoxes(ds boltq.DataStore) (boxes map[string]Box, err error) {
+	boxes = make(map[string]Box)
+	err = ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOX_COL))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var box Box
+			e := json.Unmarshal(v, &box)
+			if e == nil {
+				boxes[string(k)] = box
+			}
+			return e
+		})
+	})
+	return
+}
+
+/*
+storeBox creates or updates the box
+*/
+func storeBox(ds boltq.DataStore, box Box) error {
+	encoded, err := json.Marshal(box)
+	if err == nil {
+		err = ds.Update(func(tx *bolt.Tx) error {
+			b, e := tx.CreateBucketIfNotExists([]byte(BOX_COL))
+			if e == nil {
+				e = b.Put([]byte(box.Key()), encoded)
+			}
+			return e
+		})
+	}
+	return err
+}
+
+/*
+RoomBoxes is a room and the boxes in it, sorted by name
+*/
+type RoomBoxes struct {
+	Room  string
+	Boxes []Box
+}
+
+/*
+groupByRoom sorts the boxes into rooms
+*/
+func groupByRoom(boxes map[string]Box) []RoomBoxes {
+	rooms := make(map[string][]Box)
+	var names []string
+	for _, box := range boxes {
+		if _, found := rooms[box.Room]; !found {
+			names = append(names, box.Room)
+		}
+		rooms[box.Room] = append(rooms[box.Room], box)
+	}
+	sort.Strings(names)
+	rval := make([]RoomBoxes, 0, len(names))
+	for _, name := range names {
+		list := rooms[name]
+		sort.Sort(boxList(list))
+		rval = append(rval, RoomBoxes{name, list})
+	}
+	return rval
+}
+
+/*
+boxList sorts boxes by name
+*/
+type boxList []Box
+
+/*
+see Sort interface
+*/
+func (bl boxList) Len() int {
+	return len(bl)
+}
+
+/*
+see Sort interface
+*/
+func (bl boxList) Less(i, j int) bool {
+	return bl[i].Name < bl[j].Name
+}
+
+/*
+see Sort interface
+*/
+func (bl boxList) Swap(i, j int) {
+	bl[i], bl[j] = bl[j], bl[i]
+}
+
+/*
+BoxedBook is a physical copy in a box along with its comic
+*/
+type BoxedBook struct {
+	Comic *Comic
+	Book  *Book
+}
+
+/*
+Ref identifies the book in form values, see parseBookRef
+*/
+func (bb BoxedBook) Ref() string {
+	key := bb.Comic.CreateKey()
+	return fmt.Sprintf("%s/%s/%s/%d", key[0], key[1], key[2], bb.Book.Id)
+}
+
+/*
+parseBookRef splits a book reference created by BoxedBook.Ref into the comic key and book id
+*/
+func parseBookRef(ref string) (key [][]byte, id int, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 4 {
+		return nil, 0, fmt.Errorf("Invalid book reference %v", ref)
+	}
+	id, err = strconv.Atoi(parts[3])
+	if err == nil {
+		key = [][]byte{[]byte(parts[0]), []byte(parts[1]), []byte(parts[2])}
+	}
+	return
+}
+
+/*
+boxedBookList sorts books by slot
+*/
+type boxedBookList []BoxedBook
+
+/*
+see Sort interface
+*/
+func (bl boxedBookList) Len() int {
+	return len(bl)
+}
+
+/*
+see Sort interface
+*/
+func (bl boxedBookList) Less(i, j int) bool {
+	return bl[i].Book.Slot < bl[j].Book.Slot
+}
+
+/*
+see Sort interface
+*/
+func (bl boxedBookList) Swap(i, j int) {
+	bl[i], bl[j] = bl[j], bl[i]
+}
+
+/*
+getBoxContents gets the books in the box ordered by slot.
+The UNBOXED key gets books that aren't in any box.
+*/
+func getBoxContents(ds boltq.DataStore, boxKey string) (contents []BoxedBook, err error) {
+	comics, err := GetAllComics(ds)
+	for _, comic := range comics {
+		for i := range comic.Books {
+			book := &comic.Books[i]
+			if book.Box == boxKey || (boxKey == UNBOXED && book.Box == "") {
+				contents = append(contents, BoxedBook{comic, book})
+			}
+		}
+	}
+	sort.Stable(boxedBookList(contents))
+	return
+}
+
+/*
+moveBooks moves the referenced books into the box, an empty box key takes them out of their box.
+Slots are assigned in order starting at firstSlot, or after the last used slot in the box if firstSlot is zero.
+*/
+func moveBooks(ds boltq.DataStore, refs []string, boxKey string, firstSlot int,
+	editor string) (moved int, err error) {
+
+	if boxKey != "" {
+		var boxes map[string]Box
+		boxes, err = getBoxes(ds)
+		if _, found := boxes[boxKey]; err == nil && !found {
+			err = fmt.Errorf("Unknown box %v", boxKey)
+		}
+	}
+	if err == nil && boxKey != "" && firstSlot <= 0 {
+		var contents []BoxedBook
+		contents, err = getBoxContents(ds, boxKey)
+		for _, bb := range contents {
+			if bb.Book.Slot >= firstSlot {
+				firstSlot = bb.Book.Slot + 1
+			}
+		}
+		if firstSlot <= 0 {
+			firstSlot = 1
+		}
+	}
+
+	comics := make(map[string]*Comic)
+	var order []string
+	for i := 0; err == nil && i < len(refs); i += 1 {
+		var key [][]byte
+		var id int
+		key, id, err = parseBookRef(refs[i])
+		if err != nil {
+			break
+		}
+		serialized := string(boltq.SerializeComposite(key))
+		comic, loaded := comics[serialized]
+		if !loaded {
+			var c Comic
+			var found bool
+			c, found, err = getComic(ds, key)
+			if err == nil && !found {
+				err = fmt.Errorf("Unable to find comic: %v", formatKeys(key))
+			}
+			comic = &c
+			comics[serialized] = comic
+			order = append(order, serialized)
+		}
+		index := -1
+		if err == nil {
+			index = comic.BookIndex(id)
+		}
+		if err == nil && index < 0 {
+			err = fmt.Errorf("Unknown book %v", refs[i])
+		}
+		if err == nil {
+			comic.Books[index].Box = boxKey
+			comic.Books[index].Slot = 0
+			if boxKey != "" {
+				comic.Books[index].Slot = firstSlot + i
+			}
+			moved += 1
+		}
+	}
+	for i := 0; err == nil && i < len(order); i += 1 {
+		comic := comics[order[i]]
+		err = storeComic(ds, comic.CreateKey(), comic, editor)
+	}
+	if err != nil {
+		moved = 0
+	}
+	return
+}
+
+/*
+processLocation sets the box and slot for a single book from the comic view page
+*/
+func processLocation(ds boltq.DataStore, r *http.Request) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	id, err := strconv.Atoi(r.FormValue("book"))
+	if err != nil {
+		return "Unknown book"
+	}
+	slot := 0
+	slotStr := r.FormValue("slot")
+	if slotStr != "" {
+		slot, err = strconv.Atoi(slotStr)
+		if err != nil || slot < 1 {
+			return "Slot must be a positive integer"
+		}
+	}
+	ref := fmt.Sprintf("%s/%s/%s/%d", key[0], key[1], key[2], id)
+	_, err = moveBooks(ds, []string{ref}, r.FormValue("box"), slot, editorOf(r))
+	if err != nil {
+		status = fmt.Sprintf("Unable to move book: %v", err)
+	}
+	return status
+}
+
+/*
+locationFilter returns a function that selects comics with a book in the box or room
+*/
+func locationFilter(boxes map[string]Box, boxKey, room string) func(*Comic) bool {
+	return func(c *Comic) bool {
+		for i := range c.Books {
+			book := c.Books[i]
+			if boxKey != "" && book.Box == boxKey {
+				return true
+			}
+			if room != "" && book.Box != "" && boxes[book.Box].Room == room {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+/*
+ComicBoxesHandler handles requests to the storage box pages
+*/
+type ComicBoxesHandler struct {
+	loginTemplate   *template.Template
+	blockedTemplate *template.Template
+	boxesTemplate   *template.Template
+	boxTemplate     *template.Template
+	ds              boltq.DataStore
+}
+
+/*
+ComicsBoxes creates a new ComicBoxesHandler
+*/
+func ComicsBoxes(db *bolt.DB, webroot string) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	boxes := CreateTemplate(webroot, "base.html", "comicboxes.template")
+	box := CreateTemplate(webroot, "base.html", "comicbox.template")
+	ds := boltq.DataStore{db}
+	return &Wrapper{ComicBoxesHandler{login, block, boxes, box, ds}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicBoxesHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+		h.ds.DB, data, "ComicUploader", "")
+	if authorized && templateErr == nil {
+		boxKey, boxPresent := mux.Vars(r)["box"]
+		var status string
+		if r.Method == "POST" {
+			status = h.processPost(r)
+		}
+		boxes, err := getBoxes(h.ds)
+		if err != nil {
+			status = fmt.Sprintf("Problem getting boxes: %v", err)
+		}
+		data["Status"] = status
+		data["Rooms"] = groupByRoom(boxes)
+		if boxPresent {
+			box, found := boxes[boxKey]
+			if !found && boxKey != UNBOXED {
+				return &AppError{nil, "Box not found", http.StatusNotFound}
+			} else if !found {
+				box = Box{Name: UNBOXED}
+			}
+			contents, contentsErr := getBoxContents(h.ds, boxKey)
+			if contentsErr != nil {
+				data["Status"] = fmt.Sprintf("Problem getting box contents: %v", contentsErr)
+			}
+			data["Box"] = box
+			data["Contents"] = contents
+			templateErr = h.boxTemplate.Execute(w, data)
+		} else {
+			templateErr = h.boxesTemplate.Execute(w, data)
+		}
+	}
+
+	if templateErr != nil {
+		log.Printf("Problem rendering %v\n", templateErr)
+	}
+
+	return nil
+}
+
+func (h ComicBoxesHandler) processPost(r *http.Request) string {
+	var status string
+	action := r.FormValue("action")
+	if action == "add box" {
+		var box Box
+		box.Name, status = processString(r, "name", status, PageData{})
+		box.Room, status = processString(r, "room", status, PageData{})
+		if status == "" {
+			if box.Key() == UNBOXED {
+				status = fmt.Sprintf("%v is reserved, please pick another name", UNBOXED)
+			} else if err := storeBox(h.ds, box); err != nil {
+				status = fmt.Sprintf("Unable to save box: %v", err)
+			}
+		}
+	} else if action == "move books" {
+		r.ParseForm()
+		refs := r.Form["books"]
+		target := r.FormValue("target")
+		var err error
+		slot := 0
+		if r.FormValue("slot") != "" {
+			slot, err = strconv.Atoi(r.FormValue("slot"))
+		}
+		var moved int
+		if err == nil {
+			moved, err = moveBooks(h.ds, refs, target, slot, editorOf(r))
+		}
+		if err != nil {
+			status = fmt.Sprintf("Unable to move books: %v", err)
+		} else {
+			status = fmt.Sprintf("Moved %d books", moved)
+		}
+	}
+	return status
+}
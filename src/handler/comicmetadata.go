@@ -0,0 +1,351 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	METADATA_PROVIDER_KEY = "metadataProvider"
+	METADATA_CACHE_COL    = "comics_metadata_cache"
+	/* how long lookups are cached, misses expire sooner in case the provider adds the comic */
+	METADATA_CACHE_TTL = 30 * 24 * time.Hour
+	METADATA_MISS_TTL  = 24 * time.Hour
+	FILE_PROVIDER      = "file"
+)
+
+/*
+ComicMetadata is what a provider knows about a comic
+*/
+type ComicMetadata struct {
+	Comic Comic
+	/* provider specific reference passed to CoverImage, empty if the provider has no cover */
+	CoverRef string
+}
+
+/*
+MetadataProvider looks up comic details from an external source
+*/
+type MetadataProvider interface {
+	/*
+	   LookupIssue finds the comic by series and issue, found is false if the provider doesn't know it
+	*/
+	LookupIssue(seriesId, issue string) (meta ComicMetadata, found bool, err error)
+	/*
+	   LookupUPC finds the comic by barcode as normalized by ParseUPC
+	*/
+	LookupUPC(upc string) (meta ComicMetadata, found bool, err error)
+	/*
+	   CoverImage opens the cover image for the reference in the metadata
+	*/
+	CoverImage(ref string) (io.ReadCloser, error)
+}
+
+/*
+MetadataConfig selects the metadata provider, it is stored in the comics config bucket
+*/
+type MetadataConfig struct {
+	Type string
+	Path string
+}
+
+/*
+NewMetadataProvider creates the configured metadata provider with a cache in front of it.
+Returns nil if no provider is configured.
+*/
+func NewMetadataProvider(ds boltq.DataStore) MetadataProvider {
+	var config MetadataConfig
+	err := ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(COMIC_CONFIG_COL))
+		if b != nil {
+			encoded := b.Get([]byte(METADATA_PROVIDER_KEY))
+			if encoded != nil {
+				e = json.Unmarshal(encoded, &config)
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Problem reading metadata provider config: %v", err)
+		return nil
+	}
+	var provider MetadataProvider
+	switch config.Type {
+	case "":
+		return nil
+	case FILE_PROVIDER:
+		provider = NewFileMetadataProvider(config.Path)
+	default:
+		log.Printf("Unknown metadata provider type %v", config.Type)
+		return nil
+	}
+	return CachingMetadataProvider{ds, provider}
+}
+
+/*
+FileMetadataProvider looks up comics in a local JSON file, it stands in for a real service.
+The file is a list of comics in the same format as the db with an extra CoverFile field
+that is relative to the directory of the JSON file.
+*/
+type FileMetadataProvider struct {
+	path string
+}
+
+func NewFileMetadataProvider(path string) FileMetadataProvider {
+	return FileMetadataProvider{path}
+}
+
+/*
+fileMetadataEntry is a comic in the metadata file
+*/
+type fileMetadataEntry struct {
+	Comic
+	CoverFile string
+}
+
+func (fp FileMetadataProvider) load() (entries []fileMetadataEntry, err error) {
+	encoded, err := ioutil.ReadFile(fp.path)
+	if err == nil {
+		err = json.Unmarshal(encoded, &entries)
+	}
+	return
+}
+
+func (fp FileMetadataProvider) find(match func(*Comic) bool) (meta ComicMetadata, found bool, err error) {
+	entries, err := fp.load()
+	for i := 0; err == nil && i < len(entries); i += 1 {
+		if match(&entries[i].Comic) {
+			meta = ComicMetadata{entries[i].Comic, entries[i].CoverFile}
+			found = true
+			break
+		}
+	}
+	return
+}
+
+/*
+see MetadataProvider interface
+*/
+func (fp FileMetadataProvider) LookupIssue(seriesId, issue string) (ComicMetadata, bool, error) {
+	seriesKey, issueKey := SanitizeKey(seriesId), SanitizeKey(issue)
+	return fp.find(func(c *Comic) bool {
+		return c.SeriesKey() == seriesKey && c.IssueKey() == issueKey
+	})
+}
+
+/*
+see MetadataProvider interface
+*/
+func (fp FileMetadataProvider) LookupUPC(upc string) (ComicMetadata, bool, error) {
+	return fp.find(func(c *Comic) bool {
+		normalized, err := ParseUPC(c.UPC)
+		return err == nil && normalized == upc
+	})
+}
+
+/*
+see MetadataProvider interface
+*/
+func (fp FileMetadataProvider) CoverImage(ref string) (io.ReadCloser, error) {
+	dir, err := filepath.Abs(filepath.Dir(fp.path))
+	var path string
+	if err == nil {
+		path, err = filepath.Abs(filepath.Join(dir, ref))
+	}
+	if err != nil {
+		return nil, err
+	}
+	/* references come back from the browser, don't let them leave the directory */
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return nil, fmt.Errorf("Invalid cover reference %v", ref)
+	}
+	return os.Open(path)
+}
+
+/*
+CachingMetadataProvider saves lookups from another provider in the db
+*/
+type CachingMetadataProvider struct {
+	ds       boltq.DataStore
+	provider MetadataProvider
+}
+
+/*
+cachedMetadata is a lookup result in the cache bucket
+*/
+type cachedMetadata struct {
+	Found   bool
+	Fetched time.Time
+	Meta    ComicMetadata
+}
+
+func (cp CachingMetadataProvider) lookup(cacheKey string,
+	fetch func() (ComicMetadata, bool, error)) (meta ComicMetadata, found bool, err error) {
+
+	var cached cachedMetadata
+	var hit bool
+	err = cp.ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(METADATA_CACHE_COL))
+		if b != nil {
+			encoded := b.Get([]byte(cacheKey))
+			if encoded != nil {
+				hit = true
+				e = json.Unmarshal(encoded, &cached)
+			}
+		}
+		return
+	})
+	if err == nil && hit {
+		ttl := METADATA_CACHE_TTL
+		if !cached.Found {
+			ttl = METADATA_MISS_TTL
+		}
+		if time.Since(cached.Fetched) < ttl {
+			return cached.Meta, cached.Found, nil
+		}
+	}
+
+	meta, found, err = fetch()
+	if err == nil {
+		cached = cachedMetadata{found, time.Now(), meta}
+		encoded, cacheErr := json.Marshal(&cached)
+		if cacheErr == nil {
+			cacheErr = cp.ds.Update(func(tx *bolt.Tx) error {
+				b, e := tx.CreateBucketIfNotExists([]byte(METADATA_CACHE_COL))
+				if e == nil {
+					e = b.Put([]byte(cacheKey), encoded)
+				}
+				return e
+			})
+		}
+		if cacheErr != nil {
+			log.Printf("Problem caching metadata for %v: %v", cacheKey, cacheErr)
+		}
+	}
+	return
+}
+
+/*
+see MetadataProvider interface
+*/
+func (cp CachingMetadataProvider) LookupIssue(seriesId, issue string) (ComicMetadata, bool, error) {
+	cacheKey := fmt.Sprintf("issue/%v/%v", SanitizeKey(seriesId), SanitizeKey(issue))
+	return cp.lookup(cacheKey, func() (ComicMetadata, bool, error) {
+		return cp.provider.LookupIssue(seriesId, issue)
+	})
+}
+
+/*
+see MetadataProvider interface
+*/
+func (cp CachingMetadataProvider) LookupUPC(upc string) (ComicMetadata, bool, error) {
+	return cp.lookup("upc/"+upc, func() (ComicMetadata, bool, error) {
+		return cp.provider.LookupUPC(upc)
+	})
+}
+
+/*
+see MetadataProvider interface, covers aren't cached since they are stored with the comic
+*/
+func (cp CachingMetadataProvider) CoverImage(ref string) (io.ReadCloser, error) {
+	return cp.provider.CoverImage(ref)
+}
+
+/*
+fillFromMetadata sets the upload form fields the provider knows, anything already typed in is kept otherwise
+*/
+func fillFromMetadata(data PageData, meta ComicMetadata) {
+	comic := &meta.Comic
+	values := comicFormValues(comic)
+	if comic.Year == 0 {
+		delete(values, "date")
+	}
+	if comic.ChronOffset == 0 {
+		delete(values, "chronOffset")
+	}
+	if comic.CoverPrice == 0 {
+		delete(values, "coverPrice")
+	}
+	for field, value := range values {
+		if value != "" {
+			data[field] = value
+		}
+	}
+	if meta.CoverRef != "" {
+		data["metadataCover"] = meta.CoverRef
+	}
+}
+
+/*
+processMetadataLookup fills in the upload form from the metadata provider
+using the barcode if there is one, otherwise the series and issue
+*/
+func processMetadataLookup(ds boltq.DataStore, r *http.Request, data PageData) string {
+	provider := NewMetadataProvider(ds)
+	if provider == nil {
+		return "No metadata provider is configured"
+	}
+	/* keep what was typed in */
+	for field := range comicFormValues(&Comic{}) {
+		if value := r.FormValue(field); value != "" {
+			data[field] = value
+		}
+	}
+
+	var meta ComicMetadata
+	var found bool
+	var err error
+	var desc string
+	upc, status := processUPC(r, "upc", "", data)
+	if status != "" {
+		return status
+	} else if upc != "" {
+		desc = "barcode " + upc
+		meta, found, err = provider.LookupUPC(upc)
+	} else {
+		var seriesId, issue string
+		seriesId, status = processString(r, "seriesId", status, data)
+		issue, status = processString(r, "issue", status, data)
+		if status != "" {
+			return status
+		}
+		desc = fmt.Sprintf("%v #%v", seriesId, issue)
+		meta, found, err = provider.LookupIssue(seriesId, issue)
+	}
+	if err != nil {
+		return fmt.Sprintf("Problem looking up %v: %v", desc, err.Error())
+	} else if !found {
+		return fmt.Sprintf("No details found for %v", desc)
+	}
+	fillFromMetadata(data, meta)
+	return fmt.Sprintf("Details found for %v, check them and submit to add the comic", desc)
+}
+
+/*
+processMetadataCover stores the cover image from the metadata provider for the comic
+*/
+func processMetadataCover(ds boltq.DataStore, ref string, comic *Comic, storer FileStorer,
+	specs []RenditionSpec, limits CoverLimits) (uploaded bool, status string) {
+
+	provider := NewMetadataProvider(ds)
+	if provider == nil {
+		return false, "No metadata provider is configured"
+	}
+	src, err := provider.CoverImage(ref)
+	if err != nil {
+		return false, fmt.Sprintf("Unable to get cover from metadata provider: %v", err.Error())
+	}
+	defer src.Close()
+	return storeCover(src, comic, storer, specs, limits)
+}
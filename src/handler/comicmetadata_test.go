@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+/*
+countingProvider wraps a provider and counts the lookups that reach it
+*/
+type countingProvider struct {
+	MetadataProvider
+	lookups *int
+}
+
+func (cp countingProvider) LookupIssue(seriesId, issue string) (ComicMetadata, bool, error) {
+	*cp.lookups += 1
+	return cp.MetadataProvider.LookupIssue(seriesId, issue)
+}
+
+/*
+writeMetadataFile creates a metadata file with one comic and its cover in a temp dir
+*/
+func writeMetadataFile(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "comicmetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []fileMetadataEntry{
+		{Comic{SeriesId: "Star Wars", Issue: "1", Title: "Star Wars", UPC: "070989311428"}, "covers/sw1.jpg"},
+	}
+	encoded, err := json.Marshal(entries)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "meta.json"), encoded, 0600)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, "covers"), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "covers", "sw1.jpg"), []byte("cover"), 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestFileMetadataLookup(t *testing.T) {
+	dir := writeMetadataFile(t)
+	defer os.RemoveAll(dir)
+	provider := NewFileMetadataProvider(filepath.Join(dir, "meta.json"))
+
+	meta, found, err := provider.LookupIssue("star wars", "1")
+	if err != nil || !found || meta.Comic.Title != "Star Wars" || meta.CoverRef != "covers/sw1.jpg" {
+		t.Fatalf("unexpected lookup %+v %v %v", meta, found, err)
+	}
+	_, found, err = provider.LookupIssue("star wars", "2")
+	if err != nil || found {
+		t.Errorf("expected a miss, got %v %v", found, err)
+	}
+	upc, _ := ParseUPC("070989311428")
+	meta, found, err = provider.LookupUPC(upc)
+	if err != nil || !found || meta.Comic.Issue != "1" {
+		t.Errorf("unexpected barcode lookup %+v %v %v", meta, found, err)
+	}
+}
+
+func TestFileMetadataCoverImage(t *testing.T) {
+	dir := writeMetadataFile(t)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* a bare file name is how the path is usually configured */
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, path := range []string{"meta.json", filepath.Join(dir, "meta.json")} {
+		provider := NewFileMetadataProvider(path)
+		file, err := provider.CoverImage("covers/sw1.jpg")
+		if err != nil {
+			t.Fatalf("unable to open cover with path %v: %v", path, err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || string(data) != "cover" {
+			t.Errorf("unexpected cover %q %v", data, err)
+		}
+		for _, ref := range []string{"../secret.txt", "covers/../../secret.txt", "."} {
+			file, err = provider.CoverImage(ref)
+			if err == nil {
+				file.Close()
+				t.Errorf("expected %v to be rejected with path %v", ref, path)
+			}
+		}
+	}
+	sub := NewFileMetadataProvider(filepath.Join(dir, "covers", "meta.json"))
+	if file, err := sub.CoverImage("../secret.txt"); err == nil {
+		file.Close()
+		t.Error("expected a reference outside the directory to be rejected")
+	}
+}
+
+/*
+ageCachedMetadata moves the fetch time of a cache entry back by the duration
+*/
+func ageCachedMetadata(t *testing.T, ds boltq.DataStore, cacheKey string, age time.Duration) {
+	err := ds.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(METADATA_CACHE_COL))
+		var cached cachedMetadata
+		e := json.Unmarshal(b.Get([]byte(cacheKey)), &cached)
+		if e == nil {
+			cached.Fetched = cached.Fetched.Add(-age)
+			var encoded []byte
+			encoded, e = json.Marshal(&cached)
+			if e == nil {
+				e = b.Put([]byte(cacheKey), encoded)
+			}
+		}
+		return e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachingMetadataTTL(t *testing.T) {
+	dir := writeMetadataFile(t)
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ds := boltq.DataStore{db}
+	var lookups int
+	provider := CachingMetadataProvider{ds,
+		countingProvider{NewFileMetadataProvider(filepath.Join(dir, "meta.json")), &lookups}}
+
+	check := func(issue string, expectFound bool, expectLookups int) {
+		_, found, err := provider.LookupIssue("Star Wars", issue)
+		if err != nil || found != expectFound || lookups != expectLookups {
+			t.Fatalf("issue %v: found %v, %d lookups, %v", issue, found, lookups, err)
+		}
+	}
+	check("1", true, 1)
+	check("1", true, 1)
+	check("2", false, 2)
+	check("2", false, 2)
+
+	/* misses expire before hits */
+	age := METADATA_MISS_TTL + time.Hour
+	ageCachedMetadata(t, ds, "issue/star_wars/1", age)
+	ageCachedMetadata(t, ds, "issue/star_wars/2", age)
+	check("1", true, 2)
+	check("2", false, 3)
+	check("2", false, 3)
+
+	ageCachedMetadata(t, ds, "issue/star_wars/1", METADATA_CACHE_TTL)
+	check("1", true, 4)
+	check("1", true, 4)
+}
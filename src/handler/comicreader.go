@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"archive/zip"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	DIGITAL_DIR       = "digital"
+	DIGITAL_MAX_BYTES = 1 << 30
+	READING_COL       = "comics.reading"
+	READER_ROLE       = "ComicReader"
+	/* number of pages after the current one that the reader loads ahead of time */
+	READER_PREFETCH = 3
+	READER_AUTH_MSG = `Digital copies are only available to friends and family.
+If you would like to request access, please contact Brian and he will add you to
+the access list. Thanks!`
+)
+
+/* pageTypes are the image extensions that are treated as pages in an archive */
+var pageTypes = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+/*
+processDigital reads the comic archive from the request and attaches it to the comic
+*/
+func processDigital(ds boltq.DataStore, storer FileStorer, r *http.Request) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	comic, found, err := getComic(ds, key)
+	if err != nil {
+		return fmt.Sprintf("Can't lookup comic: %v", err.Error())
+	} else if !found {
+		return fmt.Sprintf("Unable to find comic: %v", formatKeys(key))
+	}
+
+	formFile, header, err := r.FormFile("digital")
+	if err != nil {
+		if err == http.ErrMissingFile {
+			return "Missing comic archive"
+		}
+		return fmt.Sprintf("Unable to save comic archive: %v", err.Error())
+	}
+	defer formFile.Close()
+
+	size, err := formFile.Seek(0, os.SEEK_END)
+	if err == nil {
+		_, err = formFile.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		return fmt.Sprintf("Unable to read comic archive: %v", err.Error())
+	}
+	if size > DIGITAL_MAX_BYTES {
+		return fmt.Sprintf("Comic archive is too large, limit is %d bytes", DIGITAL_MAX_BYTES)
+	}
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if ext == ".cbr" || ext == ".rar" {
+		return "CBR archives aren't supported, please convert to CBZ"
+	}
+	zr, err := zip.NewReader(formFile, size)
+	if err != nil {
+		return "Comic archive must be a CBZ (zip) file"
+	}
+	if len(archivePages(zr.File)) == 0 {
+		return "Comic archive doesn't contain any pages"
+	}
+
+	/* a new name for each upload so cached copies of the old archive are never used,
+	   the storer keeps the digital directory out of public reach, see isPrivateDir */
+	dirName := filepath.Join(DIGITAL_DIR, comic.SeriesKey())
+	fileName := fmt.Sprintf("%v_%v_%d.cbz", comic.IssueKey(), comic.CoverKey(), time.Now().Unix())
+	err = storer.Store("application/vnd.comicbook+zip", dirName, fileName, formFile, size)
+	if err != nil {
+		return fmt.Sprintf("Unable to save comic archive: %v", err.Error())
+	}
+
+	previous := comic.DigitalPath
+	comic.DigitalPath = filepath.Join(dirName, fileName)
+	err = storeComic(ds, key, &comic, editorOf(r))
+	if err != nil {
+		return fmt.Sprintf("Unable to save comic: %v", err.Error())
+	}
+	if previous != "" {
+		prevDir, prevFile := filepath.Split(previous)
+		err = storer.Delete(prevDir, prevFile)
+		if err != nil {
+			log.Printf("Problem deleting old comic archive %v: %v", previous, err)
+		}
+	}
+	return "digital copy attached"
+}
+
+/*
+archivePages returns the image files in the archive sorted by name
+*/
+func archivePages(files []*zip.File) []*zip.File {
+	var pages []*zip.File
+	for _, f := range files {
+		name := f.Name
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") ||
+			strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if pageTypes[strings.ToLower(path.Ext(name))] {
+			pages = append(pages, f)
+		}
+	}
+	sort.Sort(pageList(pages))
+	return pages
+}
+
+/*
+pageList sorts archive files by case insensitive name
+*/
+type pageList []*zip.File
+
+/*
+see Sort interface
+*/
+func (pl pageList) Len() int {
+	return len(pl)
+}
+
+/*
+see Sort interface
+*/
+func (pl pageList) Less(i, j int) bool {
+	return strings.ToLower(pl[i].Name) < strings.ToLower(pl[j].Name)
+}
+
+/*
+see Sort interface
+*/
+func (pl pageList) Swap(i, j int) {
+	pl[i], pl[j] = pl[j], pl[i]
+}
+
+/*
+getReadingPosition gets the last page the user was on for the comic, 1 if they haven't read it
+*/
+func getReadingPosition(ds boltq.DataStore, email string, key [][]byte) int {
+	page := 1
+	err := ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(READING_COL))
+		if b != nil {
+			b = b.Bucket([]byte(email))
+		}
+		if b != nil {
+			stored := b.Get(boltq.SerializeComposite(key))
+			if stored != nil {
+				page, e = strconv.Atoi(string(stored))
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Problem reading position for %v: %v", email, err)
+		page = 1
+	}
+	return page
+}
+
+/*
+storeReadingPosition saves the page the user is on for the comic
+*/
+func storeReadingPosition(ds boltq.DataStore, email string, key [][]byte, page int) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(READING_COL))
+		if e == nil {
+			b, e = b.CreateBucketIfNotExists([]byte(email))
+		}
+		if e == nil {
+			e = b.Put(boltq.SerializeComposite(key), []byte(strconv.Itoa(page)))
+		}
+		return e
+	})
+}
+
+/*
+ComicReaderHandler handles requests to read the digital copy of a comic
+*/
+type ComicReaderHandler struct {
+	loginTemplate   *template.Template
+	blockedTemplate *template.Template
+	readerTemplate  *template.Template
+	ds              boltq.DataStore
+	storer          FileStorer
+	cacheDir        string
+}
+
+/*
+ComicsReader creates a new ComicReaderHandler
+*/
+func ComicsReader(db *bolt.DB, webroot string, local bool) *Wrapper {
+	block := CreateTemplate(webroot, "base.html", "block.template")
+	login := CreateTemplate(webroot, "base.html", "login.template")
+	reader := CreateTemplate(webroot, "base.html", "comicreader.template")
+	ds := boltq.DataStore{db}
+	storer := NewFileStorer(ds, webroot, local)
+	/* archives are copied locally since zip needs random access */
+	cacheDir := filepath.Join(webroot, "cache", "digital")
+	return &Wrapper{ComicReaderHandler{login, block, reader, ds, storer, cacheDir}}
+}
+
+/*
+see AppHandler interface
+*/
+func (h ComicReaderHandler) Handle(w http.ResponseWriter, r *http.Request,
+	data PageData) *AppError {
+
+	login := data["Login"].(*LoginInfo)
+	_, isPage := mux.Vars(r)["page"]
+	if isPage {
+		/* page images are loaded by the reader, don't send them a login page */
+		if !login.Authenticated() || !HasRole(h.ds.DB, login.Email, READER_ROLE) {
+			return &AppError{nil, "Forbidden", http.StatusForbidden}
+		}
+	} else {
+		authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
+			h.ds.DB, data, READER_ROLE, READER_AUTH_MSG)
+		if templateErr != nil {
+			log.Printf("Problem rendering %v\n", templateErr)
+		}
+		if !authorized {
+			return nil
+		}
+	}
+
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return &AppError{nil, status, http.StatusBadRequest}
+	}
+	comic, found, err := getComic(h.ds, key)
+	if err != nil {
+		err = fmt.Errorf("Can't lookup comic: %v", err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	} else if !found || comic.DigitalPath == "" {
+		return &AppError{nil, "Digital copy not found", http.StatusNotFound}
+	}
+
+	if r.Method == "POST" {
+		page, convErr := strconv.Atoi(r.FormValue("page"))
+		if convErr != nil || page < 1 {
+			return &AppError{nil, "Page must be a positive integer", http.StatusBadRequest}
+		}
+		err = storeReadingPosition(h.ds, login.Email, key, page)
+		if err != nil {
+			err = fmt.Errorf("Unable to save reading position: %v", err)
+			return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	archive, err := h.openArchive(comic.DigitalPath)
+	if err != nil {
+		err = fmt.Errorf("Unable to open comic archive %v: %v", comic.DigitalPath, err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	}
+	defer archive.Close()
+	pages := archivePages(archive.File)
+
+	if isPage {
+		return h.servePage(w, r, pages)
+	}
+
+	page := getReadingPosition(h.ds, login.Email, key)
+	pageStr := r.FormValue("page")
+	if pageStr != "" {
+		page, _ = strconv.Atoi(pageStr)
+	}
+	if page < 1 || page > len(pages) {
+		page = 1
+	}
+	data["Comic"] = &comic
+	data["Page"] = page
+	data["PageCount"] = len(pages)
+	data["Prefetch"] = READER_PREFETCH
+	err = h.readerTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("Problem rendering %v\n", err)
+	}
+	return nil
+}
+
+/*
+servePage writes the image for the page number in the url to the response
+*/
+func (h ComicReaderHandler) servePage(w http.ResponseWriter, r *http.Request,
+	pages []*zip.File) *AppError {
+
+	page, err := strconv.Atoi(mux.Vars(r)["page"])
+	if err != nil || page < 1 || page > len(pages) {
+		return &AppError{nil, "Page not found", http.StatusNotFound}
+	}
+	f := pages[page-1]
+	rc, err := f.Open()
+	if err != nil {
+		err = fmt.Errorf("Unable to read page %v: %v", f.Name, err)
+		return &AppError{err, "Internal Server Error", http.StatusInternalServerError}
+	}
+	defer rc.Close()
+
+	headers := w.Header()
+	headers.Set("Content-Type", mime.TypeByExtension(strings.ToLower(path.Ext(f.Name))))
+	headers.Set("Content-Length", strconv.FormatUint(f.UncompressedSize64, 10))
+	/* archive paths change when a new copy is attached so pages never go stale */
+	headers.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(IMAGE_MAX_AGE.Seconds())))
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		log.Printf("Problem sending page %v: %v", f.Name, err)
+	}
+	return nil
+}
+
+/*
+openArchive opens the locally cached copy of the archive, copying it from the storer if needed
+*/
+func (h ComicReaderHandler) openArchive(digitalPath string) (*zip.ReadCloser, error) {
+	cachePath := filepath.Join(h.cacheDir, digitalPath)
+	_, err := os.Stat(cachePath)
+	if err == nil {
+		return zip.OpenReader(cachePath)
+	}
+
+	dirName, fileName := filepath.Split(digitalPath)
+	src, _, err := h.storer.Load(dirName, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	err = os.MkdirAll(filepath.Dir(cachePath), 0700)
+	var tmp *os.File
+	if err == nil {
+		/* write to a temp file first so concurrent requests never see a partial archive */
+		tmp, err = ioutil.TempFile(filepath.Dir(cachePath), fileName)
+	}
+	if err == nil {
+		_, err = io.Copy(tmp, src)
+		closeErr := tmp.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), cachePath)
+		} else {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return zip.OpenReader(cachePath)
+}
@@ -0,0 +1,387 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/* maps the keys of renamed comics to their new keys so old links keep working */
+	RENAME_COL = "comics_renamed"
+)
+
+/*
+renamedPath moves a stored cover path to the series directory and base name of the renamed comic,
+the top level directory and extension are kept
+*/
+func renamedPath(path, seriesKey, baseName string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(path)), seriesKey, baseName+filepath.Ext(path))
+}
+
+/*
+renameCoverFiles sets the cover paths of the renamed comic and returns the files that need to move,
+old paths are mapped to new paths. Gallery images and digital copies keep their paths since
+their names are unique and don't depend on the comic key.
+*/
+func renameCoverFiles(renamed *Comic) map[string]string {
+	moves := make(map[string]string)
+	if renamed.CoverPath == "" {
+		return moves
+	}
+	seriesKey := renamed.SeriesKey()
+	baseName := fmt.Sprintf("%v_%v", renamed.IssueKey(), renamed.CoverKey())
+	original := filepath.Join("covers", renamed.CoverPath)
+	moves[original] = renamedPath(original, seriesKey, baseName)
+	if renamed.RenditionPath(THUMB_RENDITION) == "" {
+		/* legacy thumbnails aren't listed in the renditions */
+		thumb := renamed.ThumbPath()
+		moves[thumb] = renamedPath(thumb, seriesKey, baseName)
+	}
+	renditions := make([]CoverRendition, len(renamed.Renditions))
+	for i, rendition := range renamed.Renditions {
+		rendition.Path = renamedPath(rendition.Path, seriesKey, baseName)
+		moves[renamed.Renditions[i].Path] = rendition.Path
+		renditions[i] = rendition
+	}
+	renamed.Renditions = renditions
+	renamed.CoverPath = filepath.Join(seriesKey, baseName+filepath.Ext(renamed.CoverPath))
+	return moves
+}
+
+/*
+copyStoredFile copies a file in the storer to a new path
+*/
+func copyStoredFile(storer FileStorer, from, to string) error {
+	dirName, fileName := filepath.Split(from)
+	file, info, err := storer.Load(dirName, fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err == nil {
+		dirName, fileName = filepath.Split(to)
+		err = storer.Store(info.ContentType, dirName, fileName,
+			bytes.NewReader(data), int64(len(data)))
+	}
+	return err
+}
+
+/*
+txMoveUserEntries moves the per user entries for the comic, like reading status and position, to the new key
+*/
+func txMoveUserEntries(tx *bolt.Tx, col string, from, to []byte) error {
+	b := tx.Bucket([]byte(col))
+	if b == nil {
+		return nil
+	}
+	var users [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			users = append(users, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for i := 0; err == nil && i < len(users); i += 1 {
+		ub := b.Bucket(users[i])
+		value := ub.Get(from)
+		if value != nil {
+			err = ub.Put(to, append([]byte(nil), value...))
+			if err == nil {
+				err = ub.Delete(from)
+			}
+		}
+	}
+	return err
+}
+
+/*
+txMoveHistory moves the comic's history to the new key, any stale history at the new key is replaced
+*/
+func txMoveHistory(tx *bolt.Tx, from, to []byte) error {
+	b := tx.Bucket([]byte(HISTORY_COL))
+	if b == nil || b.Bucket(from) == nil {
+		return nil
+	}
+	src := b.Bucket(from)
+	var err error
+	if b.Bucket(to) != nil {
+		err = b.DeleteBucket(to)
+	}
+	var dst *bolt.Bucket
+	if err == nil {
+		dst, err = b.CreateBucket(to)
+	}
+	if err == nil {
+		err = src.ForEach(func(k, v []byte) error {
+			return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+		})
+	}
+	if err == nil {
+		err = dst.SetSequence(src.Sequence())
+	}
+	if err == nil {
+		err = b.DeleteBucket(from)
+	}
+	return err
+}
+
+/*
+txMoveKeyedData moves everything stored by comic key outside the comic record itself
+*/
+func txMoveKeyedData(tx *bolt.Tx, from, to [][]byte) error {
+	fromKey, toKey := boltq.SerializeComposite(from), boltq.SerializeComposite(to)
+	err := txMoveHistory(tx, fromKey, toKey)
+	if err == nil {
+		err = txMoveUserEntries(tx, USER_DATA_COL, fromKey, toKey)
+	}
+	if err == nil {
+		err = txMoveUserEntries(tx, READING_COL, fromKey, toKey)
+	}
+	return err
+}
+
+/*
+txDeleteUserEntries removes the per user entries for the comic
+*/
+func txDeleteUserEntries(tx *bolt.Tx, col string, key []byte) error {
+	b := tx.Bucket([]byte(col))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return b.Bucket(k).Delete(key)
+		}
+		return nil
+	})
+}
+
+/*
+txDeleteKeyedData removes everything stored by comic key outside the comic record itself,
+old names that redirect to the comic are removed too
+*/
+func txDeleteKeyedData(tx *bolt.Tx, key [][]byte) error {
+	serialized := boltq.SerializeComposite(key)
+	var err error
+	if b := tx.Bucket([]byte(HISTORY_COL)); b != nil && b.Bucket(serialized) != nil {
+		err = b.DeleteBucket(serialized)
+	}
+	if err == nil {
+		err = txDeleteUserEntries(tx, USER_DATA_COL, serialized)
+	}
+	if err == nil {
+		err = txDeleteUserEntries(tx, READING_COL, serialized)
+	}
+	b := tx.Bucket([]byte(RENAME_COL))
+	var stale [][]byte
+	if err == nil && b != nil {
+		err = b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(v, serialized) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	}
+	for i := 0; err == nil && i < len(stale); i += 1 {
+		err = b.Delete(stale[i])
+	}
+	return err
+}
+
+/*
+txAddRedirect records that the comic moved, earlier redirects to the old key are pointed at the new key
+*/
+func txAddRedirect(tx *bolt.Tx, from, to [][]byte) error {
+	fromKey, toKey := boltq.SerializeComposite(from), boltq.SerializeComposite(to)
+	b, err := tx.CreateBucketIfNotExists([]byte(RENAME_COL))
+	var stale [][]byte
+	if err == nil {
+		err = b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(v, fromKey) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	}
+	for i := 0; err == nil && i < len(stale); i += 1 {
+		err = b.Put(stale[i], toKey)
+	}
+	if err == nil {
+		/* the new key is a real comic again */
+		err = b.Delete(toKey)
+	}
+	if err == nil {
+		err = b.Put(fromKey, toKey)
+	}
+	return err
+}
+
+/*
+findRenamed looks up the new key of a renamed comic, found is false if the comic wasn't renamed
+*/
+func findRenamed(ds boltq.DataStore, key [][]byte) (newKey [][]byte, found bool, err error) {
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(RENAME_COL))
+		if b != nil {
+			serialized := b.Get(boltq.SerializeComposite(key))
+			if serialized != nil {
+				found = true
+				newKey, e = boltq.DeserializeComposite(serialized)
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+renameComic changes the series, issue or cover id of the comic, moving it to a new key.
+The cover files, history, user data and indexes move with it and the old key redirects to the new one.
+*/
+func renameComic(ds boltq.DataStore, storer FileStorer, oldKey [][]byte,
+	seriesId, issue, coverId, editor string) (renamed Comic, err error) {
+
+	comic, found, err := getComic(ds, oldKey)
+	if err != nil {
+		return
+	} else if !found {
+		err = fmt.Errorf("Unable to find comic: %v", formatKeys(oldKey))
+		return
+	}
+	renamed = comic
+	renamed.SeriesId = seriesId
+	renamed.Issue = issue
+	renamed.CoverId = coverId
+	newKey := renamed.CreateKey()
+	oldSerialized := boltq.SerializeComposite(oldKey)
+	if bytes.Equal(oldSerialized, boltq.SerializeComposite(newKey)) {
+		/* only the display names changed */
+		err = storeComic(ds, newKey, &renamed, editor)
+		if err == nil {
+			updateComicIndexes(ds, renamed)
+		}
+		return
+	}
+	_, found, err = getComic(ds, newKey)
+	if err == nil && found {
+		err = fmt.Errorf("There is already a comic %v #%v (%v)",
+			seriesId, renamed.FormatIssue(), coverId)
+	}
+	if err != nil {
+		return
+	}
+
+	/* copy the cover files first so a failure leaves the comic as it was */
+	moves := renameCoverFiles(&renamed)
+	for from, to := range moves {
+		if err == nil {
+			err = copyStoredFile(storer, from, to)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to move cover: %v", err)
+		return
+	}
+
+	/* everything in the db moves in one transaction so the comic is never under both keys */
+	summary := fmt.Sprintf("renamed from %v #%v (%v)", comic.SeriesId, comic.FormatIssue(), comic.CoverId)
+	err = ds.Update(func(tx *bolt.Tx) error {
+		_, taken, e := txGetComic(tx, newKey)
+		if e == nil && taken {
+			e = fmt.Errorf("There is already a comic %v #%v (%v)",
+				seriesId, renamed.FormatIssue(), coverId)
+		}
+		if e == nil {
+			e = txMoveKeyedData(tx, oldKey, newKey)
+		}
+		if e == nil {
+			e = txWriteComic(tx, newKey, &renamed, &comic, editor, summary)
+		}
+		if e == nil {
+			e = TxUpdateCoverHashIndex(tx, renamed)
+		}
+		if e == nil {
+			e = TxUpdateUPCIndex(tx, renamed)
+		}
+		if e == nil {
+			e = TxUnindexComic(tx, oldKey, &comic)
+		}
+		if e == nil {
+			e = boltq.TxDelete(tx, []byte(COMIC_COL), oldKey...)
+		}
+		if e == nil {
+			e = TxDeleteCoverHash(tx, oldKey)
+		}
+		if e == nil {
+			e = TxDeleteUPC(tx, oldKey)
+		}
+		if e == nil {
+			e = TxDeleteAdded(tx, oldKey, comic.Added)
+		}
+		if e == nil {
+			b := tx.Bucket([]byte(MISSING_COL))
+			if b != nil {
+				e = b.Delete(oldSerialized)
+			}
+		}
+		if e == nil {
+			/* the old key was still counted when the comic was written */
+			e = TxUpdateComicTotals(tx, comic.SeriesId)
+		}
+		if e == nil {
+			e = txAddRedirect(tx, oldKey, newKey)
+		}
+		return e
+	})
+	if err != nil {
+		/* the db is unchanged, only the copied cover files need to go */
+		for _, to := range moves {
+			dirName, fileName := filepath.Split(to)
+			deleteErr := storer.Delete(dirName, fileName)
+			if deleteErr != nil {
+				log.Printf("Problem deleting copied cover file %v: %v", to, deleteErr)
+			}
+		}
+		return
+	}
+	GetTotalsWorker(ds).Trigger()
+
+	for from := range moves {
+		dirName, fileName := filepath.Split(from)
+		deleteErr := storer.Delete(dirName, fileName)
+		if deleteErr != nil {
+			log.Printf("Problem deleting old cover file %v: %v", from, deleteErr)
+		}
+	}
+	return
+}
+
+/*
+processRename renames the comic from the view page, target is the url of the renamed comic
+*/
+func processRename(ds boltq.DataStore, storer FileStorer, r *http.Request, data PageData) (target, status string) {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return
+	}
+	var seriesId, issue, coverId string
+	seriesId, status = processString(r, "newSeriesId", status, data)
+	issue, status = processString(r, "newIssue", status, data)
+	coverId, status = processString(r, "newCoverId", status, data)
+	if status != "" {
+		return
+	}
+	renamed, err := renameComic(ds, storer, key, seriesId, issue, coverId, editorOf(r))
+	if err != nil {
+		return "", err.Error()
+	}
+	return "/comics/" + renamed.FullPath(), ""
+}
@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/nfnt/resize"
+)
+
+const (
+	COMIC_CONFIG_COL = "comics.config"
+	RENDITIONS_KEY   = "renditions"
+	THUMB_RENDITION  = "thumb"
+	COVER_RENDITION  = "medium"
+	FORMAT_JPEG      = "jpeg"
+	FORMAT_PNG       = "png"
+)
+
+/*
+RenditionSpec describes one resized version of a cover that is generated at upload
+*/
+type RenditionSpec struct {
+	Name      string
+	Dir       string
+	MaxWidth  uint
+	MaxHeight uint
+	Format    string
+	Quality   int
+}
+
+/*
+Ext returns the file extension for the output format of the rendition
+*/
+func (rs RenditionSpec) Ext() string {
+	if rs.Format == FORMAT_PNG {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+/*
+ContentType returns the mime type for the output format of the rendition
+*/
+func (rs RenditionSpec) ContentType() string {
+	if rs.Format == FORMAT_PNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+/*
+defaultRenditions is used when no rendition config is found in the db.
+The thumb rendition keeps the legacy thumbs directory and size.
+*/
+var defaultRenditions = []RenditionSpec{
+	{THUMB_RENDITION, "thumbs", 250, 1000, FORMAT_JPEG, jpeg.DefaultQuality},
+	{THUMB_RENDITION + "@2x", "thumbs2x", 500, 2000, FORMAT_JPEG, jpeg.DefaultQuality},
+	{COVER_RENDITION, "medium", 400, 1600, FORMAT_JPEG, jpeg.DefaultQuality},
+	{COVER_RENDITION + "@2x", "medium2x", 800, 3200, FORMAT_JPEG, jpeg.DefaultQuality},
+	{"full", "full", 1600, 6400, FORMAT_JPEG, 90},
+}
+
+/*
+CoverRendition records where a generated rendition of the cover was stored
+*/
+type CoverRendition struct {
+	Name  string
+	Path  string
+	Width int
+}
+
+/*
+RenditionPath returns the path of the named rendition relative to the image prefix,
+or an empty string if the comic doesn't have that rendition
+*/
+func (comic *Comic) RenditionPath(name string) string {
+	for i := range comic.Renditions {
+		if comic.Renditions[i].Name == name {
+			return comic.Renditions[i].Path
+		}
+	}
+	return ""
+}
+
+/*
+ThumbPath returns the path of the cover thumbnail relative to the image prefix
+*/
+func (comic *Comic) ThumbPath() string {
+	rval := comic.RenditionPath(THUMB_RENDITION)
+	if rval == "" {
+		rval = filepath.Join("thumbs", comic.CoverPath)
+	}
+	return rval
+}
+
+/*
+CoverSrc returns the path of the display sized cover relative to the image prefix
+*/
+func (comic *Comic) CoverSrc() string {
+	rval := comic.RenditionPath(COVER_RENDITION)
+	if rval == "" {
+		rval = filepath.Join("covers", comic.CoverPath)
+	}
+	return rval
+}
+
+/*
+StoredPaths returns every file path in the file storer that belongs to the comic's cover, galleries and digital copy
+*/
+func (comic *Comic) StoredPaths() []string {
+	var candidates []string
+	if comic.CoverPath != "" {
+		candidates = append(candidates, filepath.Join("covers", comic.CoverPath), comic.ThumbPath())
+		for i := range comic.Renditions {
+			candidates = append(candidates, comic.Renditions[i].Path)
+		}
+	}
+	candidates = append(candidates, galleryPaths(comic.Gallery)...)
+	candidates = append(candidates, comic.DigitalPath)
+	for i := range comic.Books {
+		candidates = append(candidates, galleryPaths(comic.Books[i].Gallery)...)
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, p := range candidates {
+		if p != "" && !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+/*
+Srcset formats all renditions of the cover as an img srcset attribute value.
+Renditions aren't upscaled so small covers can have duplicate widths, only the first is used.
+*/
+func (comic *Comic) Srcset(prefix string) string {
+	parts := make([]string, 0, len(comic.Renditions))
+	seen := make(map[int]bool)
+	for _, r := range comic.Renditions {
+		if r.Width > 0 && !seen[r.Width] {
+			seen[r.Width] = true
+			parts = append(parts, fmt.Sprintf("%v/%v %dw", prefix, r.Path, r.Width))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+GetRenditions gets the rendition specs from the db config, falling back to the defaults
+*/
+func GetRenditions(ds boltq.DataStore) []RenditionSpec {
+	var specs []RenditionSpec
+	err := ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(COMIC_CONFIG_COL))
+		if b != nil {
+			encoded := b.Get([]byte(RENDITIONS_KEY))
+			if encoded != nil {
+				e = json.Unmarshal(encoded, &specs)
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Problem reading rendition config, using defaults: %v", err)
+		specs = nil
+	}
+	if len(specs) == 0 {
+		specs = defaultRenditions
+	}
+	return specs
+}
+
+/*
+SpecsKey creates a short fingerprint of the rendition specs,
+renditions only need to be regenerated when the specs change
+*/
+func SpecsKey(specs []RenditionSpec) string {
+	h := fnv.New64a()
+	encoded, err := json.Marshal(specs)
+	if err == nil {
+		h.Write(encoded)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+/*
+RenditionsCurrent returns true if the comic's renditions were generated with the specs
+*/
+func (comic *Comic) RenditionsCurrent(specs []RenditionSpec) bool {
+	return comic.SpecsKey != "" && comic.SpecsKey == SpecsKey(specs) &&
+		len(comic.Renditions) == len(specs)
+}
+
+/*
+decodeCover decodes the cover image and rotates it upright using any EXIF orientation
+*/
+func decodeCover(data []byte) (img image.Image, err error) {
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err == nil {
+		img = applyOrientation(img, readOrientation(data))
+	}
+	return
+}
+
+/*
+storeRenditions resizes the cover into each rendition and stores them using the storer.
+baseName is the file name without an extension, dirName is the series directory.
+*/
+func storeRenditions(img image.Image, specs []RenditionSpec, storer FileStorer,
+	dirName, baseName string) (renditions []CoverRendition, err error) {
+
+	for i := 0; err == nil && i < len(specs); i += 1 {
+		spec := specs[i]
+		var buff bytes.Buffer
+		var width int
+		width, err = makeRendition(img, spec, &buff)
+		if err == nil {
+			fileName := baseName + spec.Ext()
+			dirPath := filepath.Join(spec.Dir, dirName)
+			r := bytes.NewReader(buff.Bytes())
+			err = storer.Store(spec.ContentType(), dirPath, fileName, r, int64(buff.Len()))
+			if err == nil {
+				path := filepath.Join(dirPath, fileName)
+				renditions = append(renditions, CoverRendition{spec.Name, path, width})
+			}
+		}
+	}
+	return
+}
+
+/*
+makeRendition resizes the image to fit the spec and encodes it to w, returning the final width
+*/
+func makeRendition(img image.Image, spec RenditionSpec, w io.Writer) (width int, err error) {
+	resized := resize.Thumbnail(spec.MaxWidth, spec.MaxHeight, img, resize.Lanczos3)
+	width = resized.Bounds().Dx()
+	if spec.Format == FORMAT_PNG {
+		err = png.Encode(w, resized)
+	} else {
+		quality := spec.Quality
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(w, resized, &jpeg.Options{Quality: quality})
+	}
+	return
+}
+
+/*
+readOrientation finds the EXIF orientation tag in JPEG data.
+Returns 1 (normal) if the data has no orientation tag.
+*/
+func readOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		/* start of scan, no more metadata */
+		if marker == 0xDA {
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + segLen
+		if end > len(data) {
+			break
+		}
+		seg := data[i+4 : end]
+		if marker == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(seg[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+/*
+tiffOrientation reads the orientation tag from the first IFD of a TIFF header
+*/
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i += 1 {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry : entry+2])
+		if tag == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			break
+		}
+	}
+	return 1
+}
+
+/*
+applyOrientation transforms the image so that it displays upright for the EXIF orientation
+*/
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	var dst *image.NRGBA
+	if orientation >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y += 1 {
+		for x := 0; x < w; x += 1 {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strings"
 
 	"github.com/bclement/boltq"
 	"github.com/boltdb/bolt"
@@ -204,6 +205,7 @@ type ComicHandler struct {
 	ds             boltq.DataStore
 	webroot        string
 	imgPrefix      string
+	covers         CoverLinks
 }
 
 /*
@@ -214,36 +216,64 @@ func Comics(db *bolt.DB, webroot string, local bool) *Wrapper {
 	top := CreateTemplate(webroot, "base.html", "comictop.template")
 	series := CreateTemplate(webroot, "base.html", "comicseries.template")
 	ds := boltq.DataStore{db}
-	var imgPrefix string
+	imgPrefix := getImgPrefix(ds, local)
+	covers := newCoverLinks(ds, imgPrefix, local)
+	return &Wrapper{ComicHandler{list, top, series, ds, webroot, imgPrefix, covers}}
+}
+
+const (
+	LOCAL_IMG_PREFIX_KEY = "localImgPrefix"
+	DEFAULT_IMG_PREFIX   = "/static/comics"
+)
+
+/*
+getImgPrefix gets the url prefix for cover images from the local or S3 config depending on the local flag
+*/
+func getImgPrefix(ds boltq.DataStore, local bool) string {
 	if local {
-		imgPrefix = getLocalImgPrefix(ds)
-	} else {
-		var err error
-		imgPrefix, err = getS3ImgPrefix(ds)
-		if err != nil {
-			log.Printf("Problem getting img prefix: %v\n", err)
-		}
+		return getLocalImgPrefix(ds)
+	}
+	prefix, err := getS3ImgPrefix(ds)
+	if err != nil {
+		log.Printf("Problem getting img prefix: %v\n", err)
 	}
-	return &Wrapper{ComicHandler{list, top, series, ds, webroot, imgPrefix}}
+	return prefix
 }
 
-func getLocalImgPrefix(ds boltq.DataStore) string {
-	/* TODO this should be configurable */
-	return "/static/comics"
+func getLocalImgPrefix(ds boltq.DataStore) (prefix string) {
+	ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(COMIC_CONFIG_COL))
+		if b != nil {
+			prefix = getStringFromBucket(b, LOCAL_IMG_PREFIX_KEY)
+		}
+		return nil
+	})
+	if prefix == "" {
+		prefix = DEFAULT_IMG_PREFIX
+	}
+	return
 }
 
+/*
+getS3ImgPrefix gets the url prefix for images in the S3 bucket, the configured key prefix is added to it
+so imgPrefix should only point at the bucket
+*/
 func getS3ImgPrefix(ds boltq.DataStore) (prefix string, err error) {
+	var keyPrefix string
 	ds.View(func(tx *bolt.Tx) error {
-		/* TODO this should go in a constant */
-		b := tx.Bucket([]byte("aws.config"))
+		b := tx.Bucket([]byte(AWS_CONFIG_COL))
 		if b != nil {
 			bytes := b.Get([]byte("imgPrefix"))
 			if bytes != nil {
 				prefix = string(bytes)
 			}
+			keyPrefix = getStringFromBucket(b, "keyPrefix")
 		}
 		return nil
 	})
+	if prefix != "" && strings.Trim(keyPrefix, "/") != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/" + strings.Trim(keyPrefix, "/")
+	}
 	if prefix == "" {
 		err = fmt.Errorf("Unable to find imgPrefix in aws config")
 	}
@@ -267,6 +297,9 @@ func (h ComicHandler) Handle(w http.ResponseWriter, r *http.Request,
 	qstring := r.FormValue("q")
 	qtype := r.FormValue("qtype")
 	topSeries := r.FormValue("s")
+	mine := r.FormValue("mine")
+	boxKey := r.FormValue("box")
+	room := r.FormValue("room")
 	if seriesPresent {
 		template = h.seriesTemplate
 		terms := []*boltq.Term{boltq.Eq([]byte(series))}
@@ -286,6 +319,9 @@ func (h ComicHandler) Handle(w http.ResponseWriter, r *http.Request,
 		template = h.listTemplate
 		term := boltq.Eq([]byte(topSeries))
 		q = QueryWrapper{boltq.NewQuery([]byte("comics"), term)}
+	} else if mine != "" || boxKey != "" || room != "" {
+		template = h.listTemplate
+		q = QueryWrapper{boltq.NewQuery([]byte("comics"), boltq.Any())}
 	} else {
 		template = h.topTemplate
 		terms := []*boltq.Term{boltq.Any(), boltq.Eq([]byte("1"))}
@@ -293,10 +329,39 @@ func (h ComicHandler) Handle(w http.ResponseWriter, r *http.Request,
 	}
 	sl, e := getComics(h.ds, q)
 	if e == nil {
+		login := pagedata["Login"].(*LoginInfo)
+		all := addUserData(h.ds, pagedata, login)
+		if login.Authenticated() && HasRole(h.ds.DB, login.Email, "ComicUploader") {
+			/* uploaders can select comics for bulk edits */
+			pagedata["Uploader"] = true
+		}
+		if mine != "" && login.Authenticated() {
+			keep := userFilter(mine, all)
+			if keep != nil {
+				sl = filterSeries(sl, keep)
+				pagedata["mine"] = mine
+			}
+		}
+		if boxKey != "" || room != "" {
+			boxes, boxErr := getBoxes(h.ds)
+			if boxErr != nil {
+				log.Printf("Problem getting boxes: %v", boxErr)
+			}
+			sl = filterSeries(sl, locationFilter(boxes, boxKey, room))
+			pagedata["Boxes"] = boxes
+		}
 		sort.Sort(ByRelease{sl})
 		titles := packageTitles(sl)
 		pagedata["Titles"] = titles
 		pagedata["ImgPrefix"] = h.imgPrefix
+		pagedata["Covers"] = h.covers
+		if template == h.topTemplate {
+			recent, recentErr := getRecentComics(h.ds, RECENT_COUNT)
+			if recentErr != nil {
+				log.Printf("Problem getting recent comics: %v", recentErr)
+			}
+			pagedata["Recent"] = recent
+		}
 		templateErr = template.Execute(w, pagedata)
 	} else {
 		e = fmt.Errorf("Unable to get comics from db: %v", e)
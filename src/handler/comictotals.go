@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/bclement/boltq"
 	"github.com/boltdb/bolt"
@@ -56,6 +57,8 @@ ComicsTotals creates a new ComicTotalsHandler
 func ComicsTotals(db *bolt.DB, webroot string) *Wrapper {
 	totals := CreateTemplate(webroot, "base.html", "comictotals.template")
 	ds := boltq.DataStore{db}
+	/* pick up anything left dirty by offline tools like reindex */
+	GetTotalsWorker(ds).Trigger()
 	return &Wrapper{ComicTotalsHandler{totals, ds, webroot}}
 }
 
@@ -81,20 +84,61 @@ func (h ComicTotalsHandler) Handle(w http.ResponseWriter, r *http.Request,
 	}
 	data["TotalCount"] = totalCount
 	data["TotalValue"] = FormatCurrency(totalValue)
-	templateErr := h.totalsTemplate.Execute(w, data)
 
-	if templateErr != nil {
-		log.Printf("Problem rendering %v\n", templateErr)
+	breakdown, queryErr := getTotalsBreakdown(h.ds)
+	if queryErr != nil {
+		log.Printf("Problem finding totals breakdown: %v", queryErr)
 	}
+	data["Breakdown"] = breakdown
 
+	if r.FormValue("format") == "json" {
+		err = writeTotalsJSON(w, totals, totalCount, totalValue, breakdown)
+	} else {
+		templateErr := h.totalsTemplate.Execute(w, data)
+		if templateErr != nil {
+			log.Printf("Problem rendering %v\n", templateErr)
+		}
+	}
+
+	return err
+}
+
+/*
+TotalsReport is the JSON representation of the totals page
+*/
+type TotalsReport struct {
+	SeriesTotals []SeriesTotal
+	TotalCount   int
+	TotalValue   int
+	Breakdown    TotalsBreakdown
+}
+
+/*
+writeTotalsJSON writes the totals and breakdowns to the response as JSON
+*/
+func writeTotalsJSON(w http.ResponseWriter, totals []SeriesTotal, count, value int,
+	breakdown TotalsBreakdown) *AppError {
+
+	var err *AppError
+	report := TotalsReport{totals, count, value, breakdown}
+	encoded, e := json.Marshal(&report)
+	if e == nil {
+		headers := w.Header()
+		headers.Add("Content-Type", "application/json")
+		w.Write(encoded)
+	} else {
+		e = fmt.Errorf("Unable to encode totals: %v", e)
+		err = &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+	}
 	return err
 }
 
 /*
-getComicTotals gets the total values and book counts grouped by series
+getComicTotals gets the total values and book counts grouped by series.
+Stale totals are returned as is, they are recalculated by the totals worker.
 */
 func getComicTotals(ds boltq.DataStore) (totals []SeriesTotal, err error) {
-	err = ds.Update(func(tx *bolt.Tx) (e error) {
+	err = ds.View(func(tx *bolt.Tx) (e error) {
 		b := tx.Bucket([]byte(TOTALS_COL))
 		if b != nil {
 			c := b.Cursor()
@@ -103,14 +147,9 @@ func getComicTotals(ds boltq.DataStore) (totals []SeriesTotal, err error) {
 				e = json.Unmarshal(v, &total)
 				if e == nil {
 					if total.SeriesId == "" {
+						total.SeriesId = string(k)
 						total.UpToDate = false
 					}
-					if !total.UpToDate {
-						total, e = calculateComicTotals(tx, k)
-						if e == nil {
-							storeTotal(b, k, v, total)
-						}
-					}
 					totals = append(totals, total)
 				}
 			}
@@ -120,6 +159,87 @@ func getComicTotals(ds boltq.DataStore) (totals []SeriesTotal, err error) {
 	return
 }
 
+/*
+RecalculateComicTotals recalculates any series totals and breakdowns that are out of date
+*/
+func RecalculateComicTotals(ds boltq.DataStore) (err error) {
+	err = ds.Update(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(TOTALS_COL))
+		if b != nil {
+			var stale [][]byte
+			c := b.Cursor()
+			for k, v := c.First(); e == nil && k != nil; k, v = c.Next() {
+				var total SeriesTotal
+				e = json.Unmarshal(v, &total)
+				if e == nil && (total.SeriesId == "" || !total.UpToDate) {
+					/* cursor keys are only valid for the life of the tx */
+					stale = append(stale, append([]byte(nil), k...))
+				}
+			}
+			for i := 0; e == nil && i < len(stale); i += 1 {
+				var total SeriesTotal
+				total, e = calculateComicTotals(tx, stale[i])
+				if e == nil {
+					e = storeTotal(b, stale[i], nil, total)
+				}
+			}
+		}
+		if e == nil {
+			e = txRecalculateBreakdown(tx)
+		}
+		return
+	})
+	return
+}
+
+/*
+TotalsWorker recalculates stale totals in the background so that
+reading the totals never has to take the database write lock
+*/
+type TotalsWorker struct {
+	ds      boltq.DataStore
+	pending chan bool
+}
+
+var totalsWorkers = make(map[*bolt.DB]*TotalsWorker)
+var totalsWorkersLock sync.Mutex
+
+/*
+GetTotalsWorker returns the totals worker for the data store, starting one if needed
+*/
+func GetTotalsWorker(ds boltq.DataStore) *TotalsWorker {
+	totalsWorkersLock.Lock()
+	defer totalsWorkersLock.Unlock()
+	worker, found := totalsWorkers[ds.DB]
+	if !found {
+		/* one slot is enough, multiple requests collapse into a single pass */
+		worker = &TotalsWorker{ds, make(chan bool, 1)}
+		totalsWorkers[ds.DB] = worker
+		go worker.run()
+	}
+	return worker
+}
+
+/*
+Trigger requests a recalculation pass without blocking
+*/
+func (tw *TotalsWorker) Trigger() {
+	select {
+	case tw.pending <- true:
+	default:
+		/* a pass is already queued */
+	}
+}
+
+func (tw *TotalsWorker) run() {
+	for range tw.pending {
+		err := RecalculateComicTotals(tw.ds)
+		if err != nil {
+			log.Printf("Problem recalculating comic totals: %v", err)
+		}
+	}
+}
+
 func storeTotal(b *bolt.Bucket, k, v []byte, st SeriesTotal) (err error) {
 	v, err = json.Marshal(&st)
 	if err == nil {
@@ -152,12 +272,16 @@ func calculateComicTotals(tx *bolt.Tx, seriesKey []byte) (SeriesTotal, error) {
 }
 
 /*
-updateComicTotals updates the dirty flag for the series totals
+UpdateComicTotals updates the dirty flag for the series totals
+and schedules a background recalculation
 */
 func UpdateComicTotals(ds boltq.DataStore, seriesId string) (err error) {
 	err = ds.Update(func(tx *bolt.Tx) error {
 		return TxUpdateComicTotals(tx, seriesId)
 	})
+	if err == nil {
+		GetTotalsWorker(ds).Trigger()
+	}
 	return
 }
 
@@ -179,6 +303,9 @@ func TxUpdateComicTotals(tx *bolt.Tx, seriesId string) error {
 			b.Put(seriesKey, serialized)
 		}
 	}
+	if e == nil {
+		e = TxUpdateTotalsBreakdown(tx)
+	}
 
 	return e
 }
@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/* maps barcodes to comic keys */
+	UPC_COL = "comics_upc"
+)
+
+/*
+ParseUPC normalizes a scanned or typed barcode to its digits.
+The main code can be UPC-A or EAN-13 and may be followed by the 2 or 5 digit supplement
+that comics use to encode the issue and variant. EAN-13 codes for UPC-A barcodes are
+shortened to 12 digits so either form of the same barcode matches.
+*/
+func ParseUPC(text string) (string, error) {
+	var digits []byte
+	for _, r := range text {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, byte(r))
+		} else if r != ' ' && r != '-' {
+			return "", fmt.Errorf("Invalid barcode %v, expected only digits", text)
+		}
+	}
+	var mainLen int
+	switch len(digits) {
+	case 12, 14, 17:
+		mainLen = 12
+	case 13, 15, 18:
+		mainLen = 13
+	default:
+		return "", fmt.Errorf("Invalid barcode %v, expected 12 or 13 digits and an optional 2 or 5 digit supplement", text)
+	}
+	if !validCheckDigit(digits[:mainLen]) {
+		return "", fmt.Errorf("Invalid barcode %v, check digit doesn't match", text)
+	}
+	if mainLen == 13 && digits[0] == '0' {
+		digits = digits[1:]
+	}
+	return string(digits), nil
+}
+
+/*
+validCheckDigit verifies the last digit of a UPC-A or EAN-13 code.
+Weights alternate 3 and 1 starting from the digit next to the check digit.
+*/
+func validCheckDigit(code []byte) bool {
+	sum := 0
+	for i := len(code) - 2; i >= 0; i -= 1 {
+		digit := int(code[i] - '0')
+		if (len(code)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return (10-sum%10)%10 == int(code[len(code)-1]-'0')
+}
+
+/*
+splitUPC splits a code created by ParseUPC into the main code and supplement
+*/
+func splitUPC(upc string) (main, supplement string) {
+	switch len(upc) {
+	case 14, 17:
+		return upc[:12], upc[12:]
+	case 15, 18:
+		return upc[:13], upc[13:]
+	}
+	return upc, ""
+}
+
+/*
+FormatUPC formats the barcode for display with a space before the supplement
+*/
+func (comic *Comic) FormatUPC() string {
+	main, supplement := splitUPC(comic.UPC)
+	if supplement == "" {
+		return main
+	}
+	return main + " " + supplement
+}
+
+/*
+processUPC is a callback function to be used like processField for the optional barcode field
+*/
+func processUPC(r *http.Request, field, currStatus string, data PageData) (value, status string) {
+	text := strings.TrimSpace(r.FormValue(field))
+	if text != "" {
+		var err error
+		value, err = ParseUPC(text)
+		if err != nil {
+			status = err.Error()
+		} else {
+			data[field] = value
+		}
+	}
+	/* previous messages get passed back */
+	if currStatus != "" {
+		status = currStatus
+	}
+	return
+}
+
+/*
+FindComicByUPC returns the comic with the barcode, if no comic has the barcode found will be false
+*/
+func FindComicByUPC(ds boltq.DataStore, upc string) (comic Comic, found bool, err error) {
+	var key [][]byte
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		b := tx.Bucket([]byte(UPC_COL))
+		if b != nil {
+			serialized := b.Get([]byte(upc))
+			if serialized != nil {
+				key, e = boltq.DeserializeComposite(serialized)
+			}
+		}
+		return
+	})
+	if err == nil && key != nil {
+		comic, found, err = getComic(ds, key)
+	}
+	return
+}
+
+/*
+UpdateUPCIndex updates the barcode index for the comic
+*/
+func UpdateUPCIndex(ds boltq.DataStore, comic Comic) (err error) {
+	err = ds.Update(func(tx *bolt.Tx) error {
+		return TxUpdateUPCIndex(tx, comic)
+	})
+	return
+}
+
+/*
+TxUpdateUPCIndex points the comic's barcode at the comic and removes any old barcode for it
+*/
+func TxUpdateUPCIndex(tx *bolt.Tx, comic Comic) error {
+	key := comic.CreateKey()
+	err := txDeleteUPCs(tx, key, comic.UPC)
+	if err == nil && comic.UPC != "" {
+		var b *bolt.Bucket
+		b, err = tx.CreateBucketIfNotExists([]byte(UPC_COL))
+		if err == nil {
+			err = b.Put([]byte(comic.UPC), boltq.SerializeComposite(key))
+		}
+	}
+	return err
+}
+
+/*
+checkUPCOwner returns a status message if the comic's barcode is already used by another comic
+*/
+func checkUPCOwner(ds boltq.DataStore, comic *Comic) (status string) {
+	if comic.UPC == "" {
+		return
+	}
+	owner, taken, err := FindComicByUPC(ds, comic.UPC)
+	if err != nil {
+		status = fmt.Sprintf("Can't lookup barcode: %v", err.Error())
+	} else if taken && owner.FullPath() != comic.FullPath() {
+		status = fmt.Sprintf("Barcode %v is already used by %v #%v (%v)",
+			comic.FormatUPC(), owner.Title, owner.FormatIssue(), owner.CoverId)
+	}
+	return
+}
+
+/*
+TxDeleteUPC removes the comic with the given key from the barcode index
+*/
+func TxDeleteUPC(tx *bolt.Tx, key [][]byte) error {
+	return txDeleteUPCs(tx, key, "")
+}
+
+/*
+txDeleteUPCs removes every barcode for the comic except keep
+*/
+func txDeleteUPCs(tx *bolt.Tx, key [][]byte, keep string) (err error) {
+	b := tx.Bucket([]byte(UPC_COL))
+	if b == nil {
+		return
+	}
+	serialized := boltq.SerializeComposite(key)
+	var stale [][]byte
+	err = b.ForEach(func(k, v []byte) error {
+		if bytes.Equal(v, serialized) && string(k) != keep {
+			/* keys are only valid for the life of the tx */
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for i := 0; err == nil && i < len(stale); i += 1 {
+		err = b.Delete(stale[i])
+	}
+	return
+}
+
+/*
+comicFormValues returns the upload form fields for the comic
+*/
+func comicFormValues(comic *Comic) map[string]string {
+	return map[string]string{
+		"date":        comic.FormatDate(),
+		"chronOffset": strconv.Itoa(comic.ChronOffset),
+		"publisher":   comic.Publisher,
+		"seriesId":    comic.SeriesId,
+		"title":       comic.Title,
+		"subtitle":    comic.Subtitle,
+		"issue":       comic.Issue,
+		"coverId":     comic.CoverId,
+		"coverPrice":  comic.FormatCoverPrice(),
+		"author":      comic.Author,
+		"coverArtist": comic.CoverArtist,
+		"pencils":     comic.Pencils,
+		"inks":        comic.Inks,
+		"colors":      comic.Colors,
+		"letters":     comic.Letters,
+		"notes":       comic.Notes,
+		"upc":         comic.UPC,
+	}
+}
+
+/*
+prefillUpload sets the upload form fields from the comic so another copy can be added
+*/
+func prefillUpload(data PageData, comic *Comic) {
+	for field, value := range comicFormValues(comic) {
+		data[field] = value
+	}
+}
+
+/*
+processBarcode looks up the barcode from the upload page. If the action is view, the url
+of the comic's view page is returned, otherwise the upload form is filled in from the comic.
+*/
+func processBarcode(ds boltq.DataStore, r *http.Request, data PageData) (target, status string) {
+	upc, err := ParseUPC(r.FormValue("upc"))
+	if err != nil {
+		return "", err.Error()
+	}
+	comic, found, err := FindComicByUPC(ds, upc)
+	if err != nil {
+		return "", fmt.Sprintf("Can't lookup barcode: %v", err.Error())
+	} else if !found {
+		data["upc"] = upc
+		return "", lookupNewBarcode(ds, upc, data)
+	}
+	if r.FormValue("action") == "view" {
+		return "/comics/" + comic.FullPath(), ""
+	}
+	prefillUpload(data, &comic)
+	return "", fmt.Sprintf("Found %v #%v (%v), submit to add a copy",
+		comic.Title, comic.FormatIssue(), comic.CoverId)
+}
+
+/*
+lookupNewBarcode fills in the upload form from the metadata provider for a barcode that isn't in the collection
+*/
+func lookupNewBarcode(ds boltq.DataStore, upc string, data PageData) string {
+	status := fmt.Sprintf("No comic found with barcode %v, fill in the details to add it", upc)
+	provider := NewMetadataProvider(ds)
+	if provider != nil {
+		meta, found, err := provider.LookupUPC(upc)
+		if err != nil {
+			log.Printf("Problem looking up barcode %v: %v", upc, err)
+		} else if found {
+			fillFromMetadata(data, meta)
+			data["upc"] = upc
+			status = fmt.Sprintf("Barcode %v isn't in the collection yet, details were filled in from %v #%v",
+				upc, meta.Comic.Title, meta.Comic.FormatIssue())
+		}
+	}
+	return status
+}
@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/bclement/boltq"
@@ -110,9 +111,40 @@ func addSafeRange(set map[rune]bool, start, end rune) {
 Physical copy of comic book
 */
 type Book struct {
-	Grade  string
-	Value  int
-	Signed bool
+	/* unique within the comic, ids aren't reused when books are removed */
+	Id        int
+	Grade     string
+	Value     int
+	Signed    bool
+	Signature Signature
+	Gallery   []GalleryImage
+	Loans     []Loan
+	Box       string
+	Slot      int
+}
+
+/*
+Signature holds the provenance of a signed book, any of the details may be unknown
+*/
+type Signature struct {
+	Signer string
+	/* free form since signing dates are often only known roughly */
+	Date        string
+	Place       string
+	Witness     string
+	Certificate string
+	/* path of the signature photo in the book gallery */
+	Photo string
+}
+
+/*
+FormatSigner names the signer for display
+*/
+func (b *Book) FormatSigner() string {
+	if b.Signature.Signer == "" {
+		return UNKNOWN_SIGNER
+	}
+	return b.Signature.Signer
 }
 
 func (b *Book) String() string {
@@ -132,6 +164,9 @@ Single issue of comic with unique cover
 */
 type Comic struct {
 	CoverPath   string
+	Renditions  []CoverRendition
+	SpecsKey    string
+	CoverHash   string
 	Year        int
 	Month       int
 	Publisher   string
@@ -140,6 +175,7 @@ type Comic struct {
 	Subtitle    string
 	Issue       string
 	CoverId     string
+	UPC         string
 	CoverPrice  int
 	ChronOffset int
 	Author      string
@@ -150,6 +186,12 @@ type Comic struct {
 	Letters     string
 	Notes       string
 	Books       []Book
+	/* last book id handed out */
+	BookSeq     int
+	Gallery     []GalleryImage
+	DigitalPath string
+	Added       time.Time
+	Updated     time.Time
 }
 
 /*
@@ -397,16 +439,7 @@ func ComicUpload(db *bolt.DB, webroot string, local bool) *Wrapper {
 	login := CreateTemplate(webroot, "base.html", "login.template")
 	upload := CreateTemplate(webroot, "base.html", "comicupload.template")
 	ds := boltq.DataStore{db}
-	var storer FileStorer
-	if local {
-		storer = NewLocalStore(webroot)
-	} else {
-		var err error
-		storer, err = NewS3Store(ds)
-		if err != nil {
-			log.Printf("Problem creating S3 file store: %v\n", err)
-		}
-	}
+	storer := NewFileStorer(ds, webroot, local)
 	return &Wrapper{ComicUploadHandler{login, block, upload, ds, webroot, storer}}
 }
 
@@ -452,9 +485,18 @@ func (h ComicUploadHandler) Handle(w http.ResponseWriter, r *http.Request,
 	authorized, templateErr := handleAuth(w, r, h.loginTemplate, h.blockedTemplate,
 		h.ds.DB, data, "ComicUploader", "")
 	if authorized && templateErr == nil {
-		if r.Method == "POST" {
+		if r.Method == "POST" && r.FormValue("action") == "lookup" {
+			data["Status"] = processMetadataLookup(h.ds, r, data)
+		} else if r.Method == "POST" {
 			status := processUpload(h.ds, h.storer, r, data)
 			data["Status"] = status
+		} else if r.FormValue("upc") != "" {
+			target, status := processBarcode(h.ds, r, data)
+			if target != "" {
+				http.Redirect(w, r, target, http.StatusSeeOther)
+				return nil
+			}
+			data["Status"] = status
 		}
 		templateErr = h.uploadTemplate.Execute(w, data)
 	}
@@ -501,7 +543,13 @@ func processUpload(ds boltq.DataStore, storer FileStorer, r *http.Request, data
 	comic.Colors, status = processString(r, "colors", status, data)
 	comic.Letters, status = processString(r, "letters", status, data)
 	comic.Notes, status = processString(r, "notes", status, data)
-	comic.CoverPath, status = processCover(r, &comic, storer)
+	/* the barcode is optional, it is only changed if the form has the field */
+	if _, present := r.Form["upc"]; present {
+		comic.UPC, status = processUPC(r, "upc", status, data)
+	}
+	if status == "" {
+		status = checkUPCOwner(ds, &comic)
+	}
 	if status == "" {
 		var book Book
 		/* TODO validate grade value? */
@@ -510,27 +558,44 @@ func processUpload(ds boltq.DataStore, storer FileStorer, r *http.Request, data
 			book.Value, status = processMoney(r, "value", status, data)
 			signedStr := r.FormValue("signed")
 			book.Signed = signedStr == "true"
+			processSignature(&book, r, false)
 			comic.Books = append(comic.Books, book)
 		}
-		if status == "" {
-			err = storeComic(ds, key, &comic)
-			if err != nil {
-				status = fmt.Sprintf("Unable to save comic: %v", err.Error())
-			} else {
-				missingErr := UpdateMissingIndex(ds, comic)
-				if missingErr != nil {
-					log.Printf("Problem updating missing index %v", missingErr)
-				}
-				totalsErr := UpdateComicTotals(ds, comic.SeriesId)
-				if totalsErr != nil {
-					log.Printf("Problem updating comic totals %v", totalsErr)
-				}
-			}
+	}
+	/* files are only stored once everything else is valid so rejected uploads don't leave any behind */
+	previous := comic
+	var coverUploaded bool
+	if status == "" {
+		specs := GetRenditions(ds)
+		limits := getCoverLimits(ds)
+		metadataCover := r.FormValue("metadataCover")
+		coverSent := r.MultipartForm != nil && len(r.MultipartForm.File["cover"]) > 0
+		if !coverSent && metadataCover != "" {
+			/* the upload form was filled in by the metadata provider */
+			coverUploaded, status = processMetadataCover(ds, metadataCover, &comic, storer, specs, limits)
+		} else {
+			coverUploaded, status = processCover(r, &comic, storer, specs, limits)
+		}
+	}
+	var warning string
+	if coverUploaded {
+		warning = checkDuplicateCover(ds, key, comic.CoverHash)
+	}
+	if status == "" {
+		err = storeComic(ds, key, &comic, editorOf(r))
+		if err != nil {
+			status = fmt.Sprintf("Unable to save comic: %v", err.Error())
+			deleteStoredFiles(storer, comic.StoredPaths(), &previous)
+		} else {
+			updateComicIndexes(ds, comic)
 		}
 	}
 
 	if status == "" {
 		status = "comic uploaded successfully"
+		if warning != "" {
+			status += ". " + warning
+		}
 	}
 
 	return status
@@ -541,34 +606,80 @@ getComic returns the comic in the db matching the key.
 if no such comic exists in the db, found will be false
 */
 func getComic(ds boltq.DataStore, key [][]byte) (comic Comic, found bool, err error) {
-	found = false
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		comic, found, e = txGetComic(tx, key)
+		return
+	})
+	return
+}
+
+/*
+txGetComic is getComic for use inside a transaction
+*/
+func txGetComic(tx *bolt.Tx, key [][]byte) (comic Comic, found bool, err error) {
 	terms := boltq.EqAll(key)
 	query := boltq.NewQuery([]byte(COMIC_COL), terms...)
-	err = ds.View(func(tx *bolt.Tx) error {
-		encoded, e := boltq.TxQuery(tx, query)
-		if encoded != nil && e == nil {
-			/* TODO report if dups found */
-			found = true
-			e = json.Unmarshal(encoded[0], &comic)
-		}
-		return e
-	})
+	encoded, err := boltq.TxQuery(tx, query)
+	if encoded != nil && err == nil {
+		/* TODO report if dups found */
+		found = true
+		err = json.Unmarshal(encoded[0], &comic)
+		assignBookIds(&comic)
+	}
 	return
 }
 
 /*
 storeComic stores the provided comic in the db usig the provided key
+and records the change in the comic's history, editor is the email of the user making the change
 */
-func storeComic(ds boltq.DataStore, key [][]byte, comic *Comic) error {
-	encoded, err := json.Marshal(comic)
+func storeComic(ds boltq.DataStore, key [][]byte, comic *Comic, editor string) error {
+	return storeComicVersion(ds, key, comic, editor, "")
+}
+
+/*
+storeComicVersion is storeComic with a summary of the change for the history
+*/
+func storeComicVersion(ds boltq.DataStore, key [][]byte, comic *Comic, editor, summary string) error {
+	prev, found, err := getComic(ds, key)
 	if err == nil {
-		err = ds.Store([]byte(COMIC_COL), key, encoded)
+		if !found && comic.Added.IsZero() {
+			/* comics stored before timestamps were recorded shouldn't show up as recently added */
+			comic.Added = time.Now()
+		}
+		err = writeComic(ds, key, comic, &prev, editor, summary)
 	}
+	return err
+}
 
+/*
+writeComic stores and indexes the comic, the history records the changes from prev
+*/
+func writeComic(ds boltq.DataStore, key [][]byte, comic, prev *Comic, editor, summary string) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		return txStoreComic(tx, key, comic, prev, editor, summary)
+	})
+}
+
+/*
+txStoreComic is writeComic for use inside a transaction, the comic isn't saved unless its history is
+*/
+func txStoreComic(tx *bolt.Tx, key [][]byte, comic, prev *Comic, editor, summary string) error {
+	comic.Updated = time.Now()
+	assignBookIds(comic)
+	encoded, err := json.Marshal(comic)
 	if err == nil {
-		err = IndexComic(ds, key, comic)
+		err = boltq.TxStore(tx, []byte(COMIC_COL), key, encoded)
+	}
+	if err == nil {
+		err = TxIndexComic(tx, key, comic)
+	}
+	if err == nil {
+		err = TxUpdateAddedIndex(tx, key, comic, prev)
+	}
+	if err == nil {
+		err = txAppendHistory(tx, key, prev, comic, editor, summary)
 	}
-
 	return err
 }
 
@@ -581,18 +692,39 @@ func IndexComic(ds boltq.DataStore, key [][]byte, comic *Comic) (err error) {
 }
 
 func TxIndexComic(tx *bolt.Tx, key [][]byte, comic *Comic) (err error) {
-	err = indexString(tx, comic.Title, key, err)
-	err = indexString(tx, comic.Subtitle, key, err)
-	err = indexString(tx, comic.Author, key, err)
-	err = indexString(tx, comic.CoverArtist, key, err)
-	err = indexString(tx, comic.Pencils, key, err)
-	err = indexString(tx, comic.Inks, key, err)
-	err = indexString(tx, comic.Colors, key, err)
-	err = indexString(tx, comic.Letters, key, err)
-	err = indexString(tx, comic.Notes, key, err)
+	for _, str := range indexedStrings(comic) {
+		err = indexString(tx, str, key, err)
+	}
+	return
+}
+
+/*
+TxUnindexComic removes the comic's words from the reverse index, it's used when the comic moves to a new key
+*/
+func TxUnindexComic(tx *bolt.Tx, key [][]byte, comic *Comic) (err error) {
+	col := []byte(COMIC_COL)
+	idx := []byte(COMIC_INDEX)
+	for _, str := range indexedStrings(comic) {
+		tokens := normalizeIndexTokens(tx, str)
+		for i := 0; err == nil && i < len(tokens); i += 1 {
+			err = boltq.TxUnindex(tx, col, idx, tokens[i], key)
+		}
+	}
 	return
 }
 
+/*
+indexedStrings are the fields of the comic that can be searched
+*/
+func indexedStrings(comic *Comic) []string {
+	strs := []string{comic.Title, comic.Subtitle, comic.Author, comic.CoverArtist,
+		comic.Pencils, comic.Inks, comic.Colors, comic.Letters, comic.Notes}
+	for i := range comic.Books {
+		strs = append(strs, comic.Books[i].Signature.Signer)
+	}
+	return strs
+}
+
 /*
 indexString breaks up the string into fields and uses it to populate a reverse index
 */
@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	USER_DATA_COL  = "comics.user"
+	STATUS_UNREAD  = "unread"
+	STATUS_READING = "reading"
+	STATUS_READ    = "read"
+	MAX_RATING     = 5
+	/* filter values for the mine query parameter of the comics page */
+	FILTER_UNREAD  = "unread"
+	FILTER_READING = "reading"
+	FILTER_READ    = "read"
+	FILTER_RATED   = "rated"
+)
+
+/*
+UserComicData is a user's private reading status, rating and note for a comic
+*/
+type UserComicData struct {
+	Status string
+	Rating int
+	Note   string
+}
+
+/*
+GetStatus returns the reading status, comics without a status are unread
+*/
+func (ud UserComicData) GetStatus() string {
+	if ud.Status == "" {
+		return STATUS_UNREAD
+	}
+	return ud.Status
+}
+
+/*
+Stars formats the rating for display
+*/
+func (ud UserComicData) Stars() string {
+	var rval []rune
+	for i := 1; i <= MAX_RATING; i += 1 {
+		if i <= ud.Rating {
+			rval = append(rval, '★')
+		} else {
+			rval = append(rval, '☆')
+		}
+	}
+	return string(rval)
+}
+
+/*
+getUserComicData gets the user's data for the comic, the zero value if none has been stored
+*/
+func getUserComicData(ds boltq.DataStore, email string, key [][]byte) (data UserComicData, err error) {
+	err = ds.View(func(tx *bolt.Tx) (e error) {
+		b := txUserBucket(tx, email)
+		if b != nil {
+			encoded := b.Get(boltq.SerializeComposite(key))
+			if encoded != nil {
+				e = json.Unmarshal(encoded, &data)
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+getAllUserComicData gets all of the user's comic data keyed by comic path
+*/
+func getAllUserComicData(ds boltq.DataStore, email string) (all map[string]UserComicData, err error) {
+	all = make(map[string]UserComicData)
+	err = ds.View(func(tx *bolt.Tx) error {
+		b := txUserBucket(tx, email)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			key, e := boltq.DeserializeComposite(k)
+			var data UserComicData
+			if e == nil {
+				e = json.Unmarshal(v, &data)
+			}
+			if e == nil {
+				all[comicKeyPath(key)] = data
+			}
+			return e
+		})
+	})
+	return
+}
+
+/*
+comicKeyPath formats the comic key the same way as Comic.FullPath
+*/
+func comicKeyPath(key [][]byte) string {
+	var comic Comic
+	comic.SeriesId = string(key[0])
+	comic.Issue = string(key[1])
+	comic.CoverId = string(key[2])
+	return comic.FullPath()
+}
+
+func txUserBucket(tx *bolt.Tx, email string) *bolt.Bucket {
+	b := tx.Bucket([]byte(USER_DATA_COL))
+	if b != nil {
+		b = b.Bucket([]byte(email))
+	}
+	return b
+}
+
+/*
+storeUserComicData saves the user's data for the comic in the user's bucket
+*/
+func storeUserComicData(ds boltq.DataStore, email string, key [][]byte, data UserComicData) error {
+	encoded, err := json.Marshal(data)
+	if err == nil {
+		err = ds.Update(func(tx *bolt.Tx) error {
+			b, e := tx.CreateBucketIfNotExists([]byte(USER_DATA_COL))
+			if e == nil {
+				b, e = b.CreateBucketIfNotExists([]byte(email))
+			}
+			if e == nil {
+				e = b.Put(boltq.SerializeComposite(key), encoded)
+			}
+			return e
+		})
+	}
+	return err
+}
+
+/*
+processUserData reads the user's reading status, rating and note from the request and saves them
+*/
+func processUserData(ds boltq.DataStore, r *http.Request, email string) string {
+	key, status := getComicVarKey(r)
+	if status != "" {
+		return status
+	}
+	var data UserComicData
+	data.Status = r.FormValue("myStatus")
+	if data.Status != STATUS_UNREAD && data.Status != STATUS_READING && data.Status != STATUS_READ {
+		return fmt.Sprintf("Unknown reading status: %v", data.Status)
+	}
+	ratingStr := r.FormValue("myRating")
+	if ratingStr != "" {
+		var err error
+		data.Rating, err = strconv.Atoi(ratingStr)
+		if err != nil || data.Rating < 0 || data.Rating > MAX_RATING {
+			return fmt.Sprintf("Rating must be between 1 and %d, or 0 to clear it", MAX_RATING)
+		}
+	}
+	data.Note = r.FormValue("myNote")
+	err := storeUserComicData(ds, email, key, data)
+	if err != nil {
+		return fmt.Sprintf("Unable to save your status: %v", err.Error())
+	}
+	return "your status was saved"
+}
+
+/*
+userFilter returns a function that selects comics matching the filter name
+using the user's data, or nil if the filter isn't known
+*/
+func userFilter(filter string, all map[string]UserComicData) func(*Comic) bool {
+	switch filter {
+	case FILTER_UNREAD:
+		/* only books in the collection, there is nothing to read otherwise */
+		return func(c *Comic) bool {
+			return len(c.Books) > 0 && all[c.FullPath()].GetStatus() == STATUS_UNREAD
+		}
+	case FILTER_READING:
+		return func(c *Comic) bool {
+			return all[c.FullPath()].GetStatus() == STATUS_READING
+		}
+	case FILTER_READ:
+		return func(c *Comic) bool {
+			return all[c.FullPath()].GetStatus() == STATUS_READ
+		}
+	case FILTER_RATED:
+		return func(c *Comic) bool {
+			return all[c.FullPath()].Rating > 0
+		}
+	}
+	return nil
+}
+
+/*
+filterSeries returns a new series list with only the comics that keep returns true for
+*/
+func filterSeries(sl SeriesList, keep func(*Comic) bool) SeriesList {
+	rval := NewSeriesList()
+	for _, seriesId := range sl.Keys {
+		for _, comic := range sl.Map[seriesId] {
+			if keep(comic) {
+				rval.Add(comic)
+			}
+		}
+	}
+	return rval
+}
+
+/*
+addUserData puts the logged in user's comic data in the page data for the templates
+*/
+func addUserData(ds boltq.DataStore, pagedata PageData, login *LoginInfo) map[string]UserComicData {
+	var all map[string]UserComicData
+	if login.Authenticated() {
+		var err error
+		all, err = getAllUserComicData(ds, login.Email)
+		if err != nil {
+			log.Printf("Problem getting comic data for %v: %v", login.Email, err)
+		}
+		pagedata["MyData"] = all
+	}
+	return all
+}
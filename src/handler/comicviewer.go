@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -21,6 +22,7 @@ type ComicViewHandler struct {
 	webroot      string
 	imgPrefix    string
 	storer       FileStorer
+	covers       CoverLinks
 }
 
 /*
@@ -29,23 +31,10 @@ Comics creates a new ComicViewHandler
 func ComicView(db *bolt.DB, webroot string, local bool) *Wrapper {
 	view := CreateTemplate(webroot, "base.html", "comicview.template")
 	ds := boltq.DataStore{db}
-	var imgPrefix string
-	var storer FileStorer
-	if local {
-		imgPrefix = getLocalImgPrefix(ds)
-		storer = NewLocalStore(webroot)
-	} else {
-		var err error
-		imgPrefix, err = getS3ImgPrefix(ds)
-		if err != nil {
-			log.Printf("Problem getting img prefix%v\n", err)
-		}
-		storer, err = NewS3Store(ds)
-		if err != nil {
-			log.Printf("Problem creating S3 store%v\n", err)
-		}
-	}
-	return &Wrapper{ComicViewHandler{view, ds, webroot, imgPrefix, storer}}
+	imgPrefix := getImgPrefix(ds, local)
+	storer := NewFileStorer(ds, webroot, local)
+	covers := newCoverLinks(ds, imgPrefix, local)
+	return &Wrapper{ComicViewHandler{view, ds, webroot, imgPrefix, storer, covers}}
 }
 
 /*
@@ -63,57 +52,149 @@ func (h ComicViewHandler) Handle(w http.ResponseWriter, r *http.Request,
 	}
 
 	var status string
-	if HasRole(h.ds.DB, login.Email, "ComicUploader") {
+	action := r.FormValue("action")
+	uploader := HasRole(h.ds.DB, login.Email, "ComicUploader")
+	if uploader {
+		/* the edit panels are shown whichever form was sent */
 		pagedata["Uploader"] = true
+	}
+	if r.Method == "DELETE" || r.Method == "PATCH" || mux.Vars(r)["op"] == "delete" {
+		if !uploader {
+			return &AppError{nil, "Forbidden", http.StatusForbidden}
+		} else if r.Method == "PATCH" {
+			return h.handlePatch(w, r)
+		}
+		return h.handleDelete(w, r)
+	} else if r.Method == "POST" && action == "save my status" && login.Authenticated() {
+		status = processUserData(h.ds, r, login.Email)
+	} else if uploader {
 		if r.Method == "POST" {
-			action := r.FormValue("action")
-			if action == "delete comic" {
-				status = processDelete(h.ds, r)
-			} else if action == "clear books" {
-				status = processClear(h.ds, r)
+			if action == "add image" || action == "delete image" ||
+				action == "move image up" || action == "move image down" {
+				status = processGallery(h.ds, h.storer, r, action)
+			} else if action == "attach digital copy" {
+				status = processDigital(h.ds, h.storer, r)
+			} else if action == "lend book" || action == "return book" {
+				status = processLoan(h.ds, r, action, pagedata)
+			} else if action == "move book" {
+				status = processLocation(h.ds, r)
+			} else if action == "revert" {
+				status = processRevert(h.ds, r)
+			} else if action == "rename" {
+				var target string
+				target, status = processRename(h.ds, h.storer, r, pagedata)
+				if target != "" {
+					http.Redirect(w, r, target, http.StatusSeeOther)
+					return nil
+				}
 			} else {
 				status = processUpload(h.ds, h.storer, r, pagedata)
 			}
 		}
 	}
 
-	return h.handleView(w, r, pagedata, status)
+	return h.handleView(w, r, pagedata, status, login)
 }
 
-func processClear(ds boltq.DataStore, r *http.Request) string {
-	key, status := getComicVarKey(r)
-	existing, found, lookupErr := getComic(ds, key)
-	if lookupErr != nil {
-		status = fmt.Sprintf("Can't lookup comic: %v", lookupErr.Error())
-	} else if !found {
-		keyStr := formatKeys(key)
-		status = fmt.Sprintf("Unable to find comic: %v", keyStr)
-	} else {
-		existing.Books = nil
-		err := storeComic(ds, key, &existing)
-		if err != nil {
-			status = fmt.Sprintf("Unable to save comic: %v", err.Error())
-		} else {
-			totalsErr := UpdateComicTotals(ds, existing.SeriesId)
-			if totalsErr != nil {
-				log.Printf("Problem updating comic totals %v", totalsErr)
-			}
+/*
+handleDelete deletes the comic, forms are redirected to the series and other clients get no content
+*/
+func (h ComicViewHandler) handleDelete(w http.ResponseWriter, r *http.Request) *AppError {
+	comic, _, appErr := loadVarComic(h.ds, r)
+	if appErr != nil {
+		return appErr
+	}
+	status := processDelete(h.ds, h.storer, r)
+	if r.Method == "POST" {
+		target := "/comics/" + comic.SeriesPath()
+		if status != "" {
+			/* the comic is still there */
+			flashStatus(w, r, status)
+			target = "/comics/" + comic.FullPath()
 		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return nil
 	}
-	return status
+	if status != "" {
+		return &AppError{errors.New(status), "Internal Server Error", http.StatusInternalServerError}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
-func processDelete(ds boltq.DataStore, r *http.Request) string {
+/*
+handlePatch updates the comic fields in the request
+*/
+func (h ComicViewHandler) handlePatch(w http.ResponseWriter, r *http.Request) *AppError {
+	comic, key, appErr := loadVarComic(h.ds, r)
+	if appErr != nil {
+		return appErr
+	}
+	status := processPatch(h.ds, &comic, r)
+	if status != "" {
+		return &AppError{nil, status, http.StatusBadRequest}
+	}
+	err := storeComic(h.ds, key, &comic, editorOf(r))
+	if err != nil {
+		e := fmt.Errorf("Unable to save comic: %v", err)
+		return &AppError{e, "Internal Server Error", http.StatusInternalServerError}
+	}
+	updateComicIndexes(h.ds, comic)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+/*
+processDelete removes the comic along with its indexes, history, user data and stored files
+*/
+func processDelete(ds boltq.DataStore, storer FileStorer, r *http.Request) string {
 	key, status := getComicVarKey(r)
 
 	if status == "" {
-		/* TODO update missing/totals index, delete cover file */
+		var comic Comic
 		err := ds.Update(func(tx *bolt.Tx) error {
-			return boltq.TxDelete(tx, []byte(COMIC_COL), key...)
+			var found bool
+			var e error
+			comic, found, e = txGetComic(tx, key)
+			if e == nil && !found {
+				e = fmt.Errorf("comic not found")
+			}
+			if e == nil {
+				e = TxUnindexComic(tx, key, &comic)
+			}
+			if e == nil {
+				e = TxDeleteAdded(tx, key, comic.Added)
+			}
+			if e == nil {
+				e = boltq.TxDelete(tx, []byte(COMIC_COL), key...)
+			}
+			if e == nil {
+				e = TxDeleteCoverHash(tx, key)
+			}
+			if e == nil {
+				e = TxDeleteUPC(tx, key)
+			}
+			if e == nil {
+				b := tx.Bucket([]byte(MISSING_COL))
+				if b != nil {
+					e = b.Delete(boltq.SerializeComposite(key))
+				}
+			}
+			if e == nil {
+				e = txDeleteKeyedData(tx, key)
+			}
+			if e == nil {
+				e = TxUpdateComicTotals(tx, comic.SeriesId)
+			}
+			return e
 		})
 		if err != nil {
 			keyStr := formatKeys(key)
 			status = fmt.Sprintf("Problem deleting comic with keys %v: %v", keyStr, err)
+		} else {
+			GetTotalsWorker(ds).Trigger()
+			/* nothing refers to the files now */
+			deleteStoredFiles(storer, comic.StoredPaths(), &Comic{})
 		}
 	}
 
@@ -149,24 +230,61 @@ func formatKeys(keys [][]byte) string {
 }
 
 func (h ComicViewHandler) handleView(w http.ResponseWriter, r *http.Request,
-	pagedata PageData, status string) *AppError {
+	pagedata PageData, status string, login *LoginInfo) *AppError {
 
 	var err *AppError
 	var templateErr error
 
-	key, status := getComicVarKey(r)
+	key, keyStatus := getComicVarKey(r)
+	if status == "" {
+		/* don't hide the result of the action */
+		status = keyStatus
+	}
+	if status == "" {
+		/* forms that redirect back here leave their result in the session */
+		status = takeFlashStatus(w, r)
+	}
 	existing, found, lookupErr := getComic(h.ds, key)
 	if lookupErr != nil {
 		status = fmt.Sprintf("Can't lookup comic: %v", lookupErr.Error())
 		/* TODO keep going? */
 	} else if !found {
+		newKey, renamed, renameErr := findRenamed(h.ds, key)
+		if renameErr != nil {
+			log.Printf("Problem looking up renamed comic: %v", renameErr)
+		} else if renamed && r.Method == "GET" {
+			http.Redirect(w, r, "/comics/"+comicKeyPath(newKey), http.StatusMovedPermanently)
+			return nil
+		}
 		keyStr := formatKeys(key)
 		status = fmt.Sprintf("Unable to find comic: %v", keyStr)
 	}
 
 	pagedata["ImgPrefix"] = h.imgPrefix
+	pagedata["Covers"] = h.covers
 	pagedata["Comic"] = &existing
 	pagedata["Status"] = status
+	addGalleryViews(pagedata, &existing, h.imgPrefix)
+	if pagedata["Uploader"] == true {
+		boxes, boxErr := getBoxes(h.ds)
+		if boxErr != nil {
+			log.Printf("Problem getting boxes: %v", boxErr)
+		}
+		pagedata["Boxes"] = boxes
+		pagedata["Rooms"] = groupByRoom(boxes)
+		history, historyErr := getComicHistory(h.ds, key)
+		if historyErr != nil {
+			log.Printf("Problem getting comic history: %v", historyErr)
+		}
+		pagedata["History"] = history
+	}
+	if login.Authenticated() {
+		myData, dataErr := getUserComicData(h.ds, login.Email, key)
+		if dataErr != nil {
+			log.Printf("Problem getting comic data for %v: %v", login.Email, dataErr)
+		}
+		pagedata["MyData"] = myData
+	}
 	templateErr = h.viewTemplate.Execute(w, pagedata)
 
 	if templateErr != nil {
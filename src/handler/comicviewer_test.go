@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+func TestDeleteUpdatesTotalsAndIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comicviewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ds := boltq.DataStore{db}
+	storer := NewLocalStore(dir)
+
+	for _, coverId := range []string{"a", "b"} {
+		comic := Comic{SeriesId: "Star Wars", Issue: "1", CoverId: coverId, Title: "Star Wars",
+			UPC: "070989311428", Books: []Book{{Grade: "VF", Value: 500}}}
+		if coverId == "b" {
+			comic.UPC = ""
+			comic.Books = nil
+		} else {
+			comic.Gallery = []GalleryImage{{Path: "gallery/star_wars/1_a_1.jpg"}}
+			data := []byte("image")
+			storer.Store("image/jpeg", "gallery/star_wars", "1_a_1.jpg", bytes.NewReader(data), int64(len(data)))
+		}
+		if err = storeComic(ds, comic.CreateKey(), &comic, "tester"); err != nil {
+			t.Fatal(err)
+		}
+		updateComicIndexes(ds, comic)
+	}
+	if err = RecalculateComicTotals(ds); err != nil {
+		t.Fatal(err)
+	}
+	key := (&Comic{SeriesId: "Star Wars", Issue: "1", CoverId: "a"}).CreateKey()
+	storeUserComicData(ds, "a@b.c", key, UserComicData{Status: "read"})
+
+	r := httptest.NewRequest("POST", "/comics/star_wars/1/a/delete", nil)
+	r = mux.SetURLVars(r, map[string]string{"series": "star_wars", "issue": "1", "cover": "a"})
+	if status := processDelete(ds, storer, r); status != "" {
+		t.Fatal(status)
+	}
+
+	if err = RecalculateComicTotals(ds); err != nil {
+		t.Fatal(err)
+	}
+	totals, err := getComicTotals(ds)
+	if err != nil || len(totals) != 1 || totals[0].Count != 0 || totals[0].Value != 0 {
+		t.Errorf("expected no books left in the series, got %+v %v", totals, err)
+	}
+	if _, found, _ := FindComicByUPC(ds, "070989311428"); found {
+		t.Error("barcode still points at the deleted comic")
+	}
+	history, err := getComicHistory(ds, key)
+	if err != nil || len(history) != 0 {
+		t.Errorf("expected the history to be deleted, got %d versions %v", len(history), err)
+	}
+	myData, err := getUserComicData(ds, "a@b.c", key)
+	if err != nil || myData.Status != "" {
+		t.Errorf("expected the user data to be deleted, got %+v %v", myData, err)
+	}
+	if _, _, err = storer.Load("gallery/star_wars", "1_a_1.jpg"); !IsNotFound(err) {
+		t.Errorf("expected the gallery image to be deleted, got %v", err)
+	}
+}
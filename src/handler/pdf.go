@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	/* US letter in points */
+	PDF_PAGE_WIDTH  = 612
+	PDF_PAGE_HEIGHT = 792
+	PDF_MARGIN      = 36
+)
+
+/*
+PDFDoc is a minimal PDF writer that supports text in the standard Helvetica fonts,
+lines and JPEG images, which is all the printed reports need
+*/
+type PDFDoc struct {
+	pages  []*bytes.Buffer
+	images [][]byte
+	sizes  [][2]int
+}
+
+/*
+NewPDFDoc creates an empty document, call AddPage before drawing
+*/
+func NewPDFDoc() *PDFDoc {
+	return &PDFDoc{}
+}
+
+/*
+AddPage starts a new page, later drawing goes to the new page
+*/
+func (doc *PDFDoc) AddPage() {
+	doc.pages = append(doc.pages, &bytes.Buffer{})
+}
+
+func (doc *PDFDoc) current() *bytes.Buffer {
+	if len(doc.pages) == 0 {
+		doc.AddPage()
+	}
+	return doc.pages[len(doc.pages)-1]
+}
+
+/*
+Text draws the string with its baseline at x, y measured from the bottom left of the page
+*/
+func (doc *PDFDoc) Text(x, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(doc.current(), "BT /%v %.1f Tf %.2f %.2f Td (%v) Tj ET\n",
+		font, size, x, y, pdfEscape(text))
+}
+
+/*
+Line draws a thin line from x1, y1 to x2, y2
+*/
+func (doc *PDFDoc) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(doc.current(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+/*
+AddJPEG adds the encoded image to the document and returns the id to pass to Image
+*/
+func (doc *PDFDoc) AddJPEG(data []byte, width, height int) int {
+	doc.images = append(doc.images, data)
+	doc.sizes = append(doc.sizes, [2]int{width, height})
+	return len(doc.images) - 1
+}
+
+/*
+Image draws the image added with AddJPEG with its bottom left corner at x, y
+*/
+func (doc *PDFDoc) Image(id int, x, y, width, height float64) {
+	fmt.Fprintf(doc.current(), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, x, y, id)
+}
+
+/*
+pdfEscape escapes the string for a PDF literal, characters outside of Latin-1 are replaced
+*/
+func pdfEscape(text string) string {
+	var buff bytes.Buffer
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			buff.WriteByte('\\')
+			buff.WriteByte(byte(r))
+		case r == '\n' || r == '\r' || r == '\t':
+			buff.WriteByte(' ')
+		case r > 0xff:
+			buff.WriteByte('?')
+		case r < 0x20 || r > 0x7e:
+			fmt.Fprintf(&buff, "\\%03o", r)
+		default:
+			buff.WriteByte(byte(r))
+		}
+	}
+	return buff.String()
+}
+
+/*
+WriteTo writes the complete document to w, see io.WriterTo interface
+*/
+func (doc *PDFDoc) WriteTo(w io.Writer) (int64, error) {
+	doc.current()
+	/* object numbers: catalog, page tree, fonts, images, then a page and its contents for each page */
+	fontObj := 3
+	imageObj := fontObj + 2
+	pageObj := imageObj + len(doc.images)
+	objects := make([][]byte, pageObj+2*len(doc.pages))
+
+	kids := make([]string, len(doc.pages))
+	for i := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageObj+2*i)
+	}
+	objects[1] = []byte("<< /Type /Catalog /Pages 2 0 R >>")
+	objects[2] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %d >>",
+		strings.Join(kids, " "), len(doc.pages)))
+	objects[fontObj] = []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	objects[fontObj+1] = []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	var xobjects []string
+	for i, data := range doc.images {
+		header := fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d "+
+			"/ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n",
+			doc.sizes[i][0], doc.sizes[i][1], len(data))
+		objects[imageObj+i] = append(append([]byte(header), data...), []byte("\nendstream")...)
+		xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", i, imageObj+i))
+	}
+	resources := fmt.Sprintf("<< /Font << /F1 %d 0 R /F2 %d 0 R >> /XObject << %v >> >>",
+		fontObj, fontObj+1, strings.Join(xobjects, " "))
+
+	for i, content := range doc.pages {
+		obj := pageObj + 2*i
+		objects[obj] = []byte(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources %v /Contents %d 0 R >>", PDF_PAGE_WIDTH, PDF_PAGE_HEIGHT, resources, obj+1))
+		objects[obj+1] = []byte(fmt.Sprintf("<< /Length %d >>\nstream\n%vendstream",
+			content.Len(), content.String()))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i := 1; i < len(objects); i += 1 {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i)
+		out.Write(objects[i])
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects))
+	for i := 1; i < len(objects); i += 1 {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offsets[i])
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects), xref)
+	return out.WriteTo(w)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"../handler"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+var dbfile = flag.String("dbfile", "", "database file, example data.db")
+var webroot = flag.String("webroot", "./", "root of web resource directory for local store")
+var local = flag.Bool("local", true, "audit the local store instead of S3")
+var deleteOrphans = flag.Bool("delete", false, "delete files that aren't referenced by any comic")
+var regen = flag.Bool("regen", false, "regenerate missing thumbnails from the stored originals")
+
+/*
+openDatabase opens the bolt embedded database file in the provided directory
+*/
+func openDatabase(filename string) *bolt.DB {
+	if _, err := os.Stat(filename); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func main() {
+
+	flag.Parse()
+	if *dbfile == "" {
+		fmt.Printf("missing dbfile argument\n")
+		return
+	}
+
+	db := openDatabase(*dbfile)
+	defer db.Close()
+	ds := boltq.DataStore{db}
+
+	storer := handler.NewFileStorer(ds, *webroot, *local)
+	specs := handler.GetRenditions(ds)
+	audit, err := handler.AuditCovers(ds, storer, specs)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		return
+	}
+
+	for _, ref := range audit.Broken {
+		original := "original missing"
+		if ref.HasOriginal {
+			original = "original found"
+		}
+		fmt.Printf("broken: %v (%v)\n", ref.Comic.FullPath(), original)
+		for _, p := range ref.Missing {
+			fmt.Printf("  missing file: %v\n", p)
+		}
+	}
+	for _, p := range audit.Orphans {
+		fmt.Printf("orphan: %v\n", p)
+	}
+	fmt.Printf("%d broken references, %d orphaned files\n", len(audit.Broken), len(audit.Orphans))
+
+	if *deleteOrphans {
+		deleted, err := handler.DeleteOrphans(storer, audit.Orphans)
+		fmt.Printf("deleted %d orphaned files\n", deleted)
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+		}
+	}
+
+	if *regen {
+		for _, ref := range audit.Broken {
+			if !ref.HasOriginal {
+				continue
+			}
+			fmt.Printf("Regenerating thumbnails for %v\n", ref.Comic.FullPath())
+			err = handler.RegenerateRenditions(ds, storer, specs, ref.Comic)
+			if err != nil {
+				fmt.Printf("  failed: %v\n", err)
+			}
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 var standalone = flag.String("standalone", "", "binding for standalone app, example 0.0.0.0:8080")
 var webroot = flag.String("webroot", "./", "root of web resource directory")
+var cachedir = flag.String("cachedir", "", "directory for resized cover images, defaults to cache/covers in the webroot")
 var local = flag.Bool("local", false, "using local file store instead of S3")
 var auth = flag.Bool("auth", true, "use OAuth for login")
 
@@ -81,6 +82,17 @@ func main() {
 	comicMissingHandler := handler.ComicsMissing(db, *webroot)
 	comicTotalsHandler := handler.ComicsTotals(db, *webroot)
 	comicViewHandler := handler.ComicView(db, *webroot, *local)
+	comicDuplicatesHandler := handler.ComicsDuplicates(db, *webroot, *local)
+	comicImageHandler := handler.ComicImages(db, *webroot, *cachedir, *local)
+	comicAuditHandler := handler.ComicsAudit(db, *webroot, *local)
+	comicReaderHandler := handler.ComicsReader(db, *webroot, *local)
+	comicLoansHandler := handler.ComicsLoans(db, *webroot)
+	comicBoxesHandler := handler.ComicsBoxes(db, *webroot)
+	comicInventoryHandler := handler.ComicsInventory(db, *webroot, *local)
+	comicFeedHandler := handler.ComicsFeed(db, *webroot, *local)
+	comicBulkHandler := handler.ComicsBulk(db, *webroot)
+	comicBooksHandler := handler.ComicBooks(db)
+	comicCreatorsHandler := handler.ComicsCreators(db, *webroot, *local)
 
 	r := mux.NewRouter()
 	r.Handle("/", homeHandler)
@@ -94,9 +106,27 @@ func main() {
 	r.Handle("/comics/upload", comicUploadHandler)
 	r.Handle("/comics/missing", comicMissingHandler)
 	r.Handle("/comics/totals", comicTotalsHandler)
+	r.Handle("/comics/duplicates", comicDuplicatesHandler)
+	r.Handle("/comics/audit", comicAuditHandler)
+	r.Handle("/comics/loans", comicLoansHandler)
+	r.Handle("/comics/boxes", comicBoxesHandler)
+	r.Handle("/comics/boxes/{box:[^/]*}", comicBoxesHandler)
+	r.Handle("/comics/inventory", comicInventoryHandler)
+	r.Handle("/comics/feed", comicFeedHandler)
+	r.Handle("/comics/bulk", comicBulkHandler)
+	r.Handle("/comics/creators", comicCreatorsHandler)
+	r.Handle("/comics/creators/{creator:[^/]+}", comicCreatorsHandler)
+	r.Handle("/comics/images/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}", comicImageHandler)
 	r.Handle("/comics/{series:[^/]*}", comicHandler)
 	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}", comicHandler)
 	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}", comicViewHandler)
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/{op:delete}", comicViewHandler).Methods("POST")
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/books", comicBooksHandler).Methods("POST", "DELETE")
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/books/{op:clear}", comicBooksHandler).Methods("POST")
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/books/{book:[0-9]+}", comicBooksHandler).Methods("POST", "PATCH", "DELETE")
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/books/{book:[0-9]+}/{op:delete}", comicBooksHandler).Methods("POST")
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/read", comicReaderHandler)
+	r.Handle("/comics/{series:[^/]*}/{issue:[^/]*}/{cover:[^/]*}/pages/{page:[0-9]+}", comicReaderHandler)
 	r.Handle("/videos", handler.Redirect("videos/"))
 	r.Handle("/videos/", videosHandler)
 	r.Handle("/videos/upload", vidUploadHandler)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/template"
+	"time"
+
+	"../handler"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+var dbfile = flag.String("dbfile", "", "database file, example data.db")
+var webroot = flag.String("webroot", "./", "root of web resource directory")
+
+/*
+openDatabase opens the bolt embedded database file in the provided directory
+*/
+func openDatabase(filename string) *bolt.DB {
+	if _, err := os.Stat(filename); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func main() {
+
+	flag.Parse()
+	if *dbfile == "" {
+		fmt.Printf("missing dbfile argument\n")
+		return
+	}
+
+	reminderTemplateFile := *webroot + "templates/loanreminder.template"
+	reminder, err := template.ParseFiles(reminderTemplateFile)
+	if err != nil {
+		fmt.Printf("unable to parse reminder file %v: %v\n", reminderTemplateFile, err)
+		return
+	}
+
+	db := openDatabase(*dbfile)
+	defer db.Close()
+
+	sent, err := handler.SendLoanReminders(boltq.DataStore{db}, reminder)
+	fmt.Printf("sent %d reminders\n", sent)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+	}
+}
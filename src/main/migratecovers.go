@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../handler"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	MIGRATION_COL = "comics.migration"
+)
+
+var dbfile = flag.String("dbfile", "", "database file, example data.db")
+var from = flag.String("from", "", "source store, either local or s3")
+var to = flag.String("to", "", "destination store, either local or s3")
+var webroot = flag.String("webroot", "./", "root of web resource directory for local store")
+var fromConfig = flag.String("fromconfig", handler.AWS_CONFIG_COL, "db bucket with source S3 config")
+var toConfig = flag.String("toconfig", handler.AWS_CONFIG_COL, "db bucket with destination S3 config")
+var restart = flag.Bool("restart", false, "ignore progress from previous runs")
+
+/*
+openDatabase opens the bolt embedded database file in the provided directory
+*/
+func openDatabase(filename string) *bolt.DB {
+	if _, err := os.Stat(filename); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+/*
+openStore creates the file storer for the store type
+*/
+func openStore(ds boltq.DataStore, storeType, configBucket string) (handler.FileStorer, error) {
+	var storer handler.FileStorer
+	var err error
+	if storeType == "local" {
+		storer = handler.NewLocalStore(*webroot)
+	} else if storeType == "s3" {
+		var config handler.S3Config
+		config, err = handler.GetS3Config(ds, configBucket)
+		if err == nil {
+			storer, err = handler.NewS3StoreFromConfig(config)
+		}
+	} else {
+		err = fmt.Errorf("unknown store type %v, expected local or s3", storeType)
+	}
+	return storer, err
+}
+
+func main() {
+
+	flag.Parse()
+	if *dbfile == "" {
+		fmt.Printf("missing dbfile argument\n")
+		return
+	}
+	if *from == "" || *to == "" {
+		fmt.Printf("missing from or to argument\n")
+		return
+	}
+
+	db := openDatabase(*dbfile)
+	defer db.Close()
+	ds := boltq.DataStore{db}
+
+	src, err := openStore(ds, *from, *fromConfig)
+	if err != nil {
+		fmt.Printf("unable to open source store: %v\n", err)
+		return
+	}
+	dest, err := openStore(ds, *to, *toConfig)
+	if err != nil {
+		fmt.Printf("unable to open destination store: %v\n", err)
+		return
+	}
+
+	/* progress is tracked per source and destination pair so runs can be resumed */
+	progressKey := []byte(fmt.Sprintf("%v:%v->%v:%v", *from, *fromConfig, *to, *toConfig))
+	if *restart {
+		err = clearProgress(ds, progressKey)
+	}
+
+	var paths []string
+	if err == nil {
+		paths, err = getCoverPaths(ds)
+	}
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		return
+	}
+
+	var missing, failed []string
+	copied, skipped := 0, 0
+	for i, p := range paths {
+		data, contentType, found, loadErr := loadFile(src, p)
+		if !found {
+			fmt.Printf("[%d/%d] %v\n", i+1, len(paths), p)
+			missing = append(missing, p)
+			continue
+		}
+		var checksum string
+		done := false
+		if loadErr == nil {
+			checksum = sum(data)
+			done, loadErr = isDone(ds, progressKey, p, checksum)
+		}
+		if done {
+			skipped += 1
+			continue
+		}
+		fmt.Printf("[%d/%d] %v\n", i+1, len(paths), p)
+		copyErr := loadErr
+		if copyErr == nil {
+			copyErr = storeFile(dest, p, contentType, data, checksum)
+		}
+		if copyErr != nil {
+			fmt.Printf("  failed: %v\n", copyErr)
+			failed = append(failed, p)
+		} else {
+			copied += 1
+			copyErr = markDone(ds, progressKey, p, checksum)
+			if copyErr != nil {
+				fmt.Printf("  unable to record progress: %v\n", copyErr)
+			}
+		}
+	}
+
+	fmt.Printf("copied %d, skipped %d already copied, %d missing, %d failed\n",
+		copied, skipped, len(missing), len(failed))
+	for _, p := range missing {
+		fmt.Printf("missing source file: %v\n", p)
+	}
+	for _, p := range failed {
+		fmt.Printf("failed to copy: %v\n", p)
+	}
+}
+
+/*
+getCoverPaths gets every stored cover file path referenced by the comics in the db
+*/
+func getCoverPaths(ds boltq.DataStore) (paths []string, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		q := boltq.NewQuery([]byte(handler.COMIC_COL), boltq.Any())
+		results, e := boltq.TxQuery(tx, q)
+		for i := 0; e == nil && i < len(results); i += 1 {
+			var comic handler.Comic
+			e = json.Unmarshal(results[i], &comic)
+			if e == nil {
+				paths = append(paths, comic.StoredPaths()...)
+			}
+		}
+		return e
+	})
+	return
+}
+
+/*
+loadFile reads the file at path from the source store.
+found is false if the file doesn't exist in the source store.
+*/
+func loadFile(src handler.FileStorer, path string) (data []byte, contentType string, found bool, err error) {
+	dirName, fileName := filepath.Split(path)
+	file, info, err := src.Load(dirName, fileName)
+	found = !handler.IsNotFound(err)
+	if err != nil {
+		return
+	}
+	data, err = ioutil.ReadAll(file)
+	file.Close()
+	contentType = info.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+	return
+}
+
+/*
+storeFile writes the file data to path in dest and verifies the copy by checksum
+*/
+func storeFile(dest handler.FileStorer, path, contentType string, data []byte, checksum string) error {
+	dirName, fileName := filepath.Split(path)
+	err := dest.Store(contentType, dirName, fileName, bytes.NewReader(data), int64(len(data)))
+	if err == nil {
+		err = verify(dest, dirName, fileName, checksum)
+	}
+	return err
+}
+
+/*
+verify reads the file back from the store and compares it to the expected checksum
+*/
+func verify(storer handler.FileStorer, dirName, fileName, checksum string) error {
+	file, _, err := storer.Load(dirName, fileName)
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(file)
+		file.Close()
+		if err == nil && sum(data) != checksum {
+			err = fmt.Errorf("checksum mismatch after copy")
+		}
+	}
+	return err
+}
+
+/*
+sum returns the hex encoded sha256 checksum of the data
+*/
+func sum(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+/*
+isDone returns true if the file at path was already copied with the same checksum.
+A source file that was replaced under the same path since the copy isn't done.
+*/
+func isDone(ds boltq.DataStore, progressKey []byte, path, checksum string) (done bool, err error) {
+	err = ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(MIGRATION_COL))
+		if b != nil {
+			b = b.Bucket(progressKey)
+		}
+		if b != nil {
+			done = string(b.Get([]byte(path))) == checksum
+		}
+		return nil
+	})
+	return
+}
+
+/*
+markDone records the checksum of the file copied to path
+*/
+func markDone(ds boltq.DataStore, progressKey []byte, path, checksum string) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		b, e := tx.CreateBucketIfNotExists([]byte(MIGRATION_COL))
+		if e == nil {
+			b, e = b.CreateBucketIfNotExists(progressKey)
+		}
+		if e == nil {
+			e = b.Put([]byte(path), []byte(checksum))
+		}
+		return e
+	})
+}
+
+/*
+clearProgress removes the recorded progress for the source and destination pair
+*/
+func clearProgress(ds boltq.DataStore, progressKey []byte) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(MIGRATION_COL))
+		if b != nil && b.Bucket(progressKey) != nil {
+			return b.DeleteBucket(progressKey)
+		}
+		return nil
+	})
+}
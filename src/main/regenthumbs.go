@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"../handler"
+
+	"github.com/bclement/boltq"
+	"github.com/boltdb/bolt"
+)
+
+var dbfile = flag.String("dbfile", "", "database file, example data.db")
+var webroot = flag.String("webroot", "./", "root of web resource directory for local store")
+var local = flag.Bool("local", true, "use the local store instead of S3")
+var workers = flag.Int("workers", 4, "number of covers to process at the same time")
+var force = flag.Bool("force", false, "regenerate even if the thumbnails are up to date")
+
+/*
+openDatabase opens the bolt embedded database file in the provided directory
+*/
+func openDatabase(filename string) *bolt.DB {
+	if _, err := os.Stat(filename); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+/*
+result is the outcome of regenerating the thumbnails for one comic
+*/
+type result struct {
+	comic *handler.Comic
+	err   error
+}
+
+func main() {
+
+	flag.Parse()
+	if *dbfile == "" {
+		fmt.Printf("missing dbfile argument\n")
+		return
+	}
+	if *workers < 1 {
+		fmt.Printf("workers must be at least 1\n")
+		return
+	}
+
+	db := openDatabase(*dbfile)
+	defer db.Close()
+	ds := boltq.DataStore{db}
+
+	storer := handler.NewFileStorer(ds, *webroot, *local)
+	specs := handler.GetRenditions(ds)
+
+	comics, err := handler.GetAllComics(ds)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		return
+	}
+
+	var todo []*handler.Comic
+	skipped := 0
+	for _, comic := range comics {
+		if comic.CoverPath == "" {
+			continue
+		}
+		if !*force && comic.RenditionsCurrent(specs) {
+			skipped += 1
+		} else {
+			todo = append(todo, comic)
+		}
+	}
+	fmt.Printf("%d comics to process, %d already up to date\n", len(todo), skipped)
+
+	jobs := make(chan *handler.Comic)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for comic := range jobs {
+				e := handler.RegenerateRenditions(ds, storer, specs, comic)
+				results <- result{comic, e}
+			}
+		}()
+	}
+	go func() {
+		for _, comic := range todo {
+			jobs <- comic
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	var failed []string
+	for res := range results {
+		done += 1
+		if res.err != nil {
+			fmt.Printf("[%d/%d] %v failed: %v\n", done, len(todo), res.comic.FullPath(), res.err)
+			failed = append(failed, res.comic.FullPath())
+		} else {
+			fmt.Printf("[%d/%d] %v\n", done, len(todo), res.comic.FullPath())
+		}
+	}
+
+	fmt.Printf("regenerated %d, skipped %d, %d failed\n", done-len(failed), skipped, len(failed))
+	for _, p := range failed {
+		fmt.Printf("failed to regenerate: %v\n", p)
+	}
+}
@@ -67,6 +67,14 @@ func index(ds boltq.DataStore, comics []*handler.Comic) (err error) {
 				fmt.Printf("Updating totals for %v, %v, %v\n", comic.SeriesId, comic.Issue, comic.CoverId)
 				e = handler.TxUpdateComicTotals(tx, comic.SeriesId)
 			}
+			if e == nil {
+				fmt.Printf("Updating cover hash for %v, %v, %v\n", comic.SeriesId, comic.Issue, comic.CoverId)
+				e = handler.TxUpdateCoverHashIndex(tx, *comic)
+			}
+			if e == nil {
+				fmt.Printf("Updating barcode for %v, %v, %v\n", comic.SeriesId, comic.Issue, comic.CoverId)
+				e = handler.TxUpdateUPCIndex(tx, *comic)
+			}
 			if e == nil {
 				fmt.Printf("Updating index for %v, %v, %v\n", comic.SeriesId, comic.Issue, comic.CoverId)
 				key := comic.CreateKey()
@@ -84,10 +92,16 @@ func deleteIndexes(ds boltq.DataStore) error {
 		idx := []byte(handler.COMIC_INDEX)
 		missing := []byte(handler.MISSING_COL)
 		totals := []byte(handler.TOTALS_COL)
+		breakdown := []byte(handler.BREAKDOWN_COL)
+		coverHash := []byte(handler.COVER_HASH_COL)
+		upc := []byte(handler.UPC_COL)
 		e := boltq.TxDeleteIndex(tx, col, idx)
 		if e == nil {
 			tx.DeleteBucket(missing)
 			tx.DeleteBucket(totals)
+			tx.DeleteBucket(breakdown)
+			tx.DeleteBucket(coverHash)
+			tx.DeleteBucket(upc)
 		}
 		return e
 	})